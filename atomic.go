@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// writeTemp writes data to a temporary file in the directory of path, which
+// can be renamed over path so that readers never see it half written.
+func writeTemp(path string, data []byte, mode os.FileMode) (string, error) {
+	// the name doesn't end with .go so that it isn't mistaken for a source
+	// or a generated file while it exists
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	temp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		// CreateTemp creates files with 0600 regardless of the umask
+		err = f.Chmod(mode)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return "", err
+	}
+	return temp, nil
+}
+
+// writeFileAtomic writes a file through a temporary file which is renamed
+// over it.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	temp, err := writeTemp(path, data, mode)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temp, path)
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+func (s *runState) markFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+}
+
+func (s *runState) hasFailed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
+
+// stage records a temporary file to rename to path once the run succeeded.
+func (s *runState) stage(path, temp string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous, ok := s.staged[path]; ok {
+		os.Remove(previous)
+	}
+	s.staged[path] = temp
+}
+
+// stageRemoval records an orphaned file to remove once the run succeeded.
+func (s *runState) stageRemoval(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removals = append(s.removals, path)
+}
+
+// commitStaged renames the files staged with -atomic into place and removes
+// the orphaned ones, unless anything failed during the run in which case the
+// staged files are discarded and nothing on disk changes. It returns false
+// if they were discarded, failures are forgotten afterwards so that -watch
+// starts over with the next changes.
+func (opts options) commitStaged() bool {
+	s := opts.state
+	s.mu.Lock()
+	paths := make([]string, 0, len(s.staged))
+	for path := range s.staged {
+		paths = append(paths, path)
+	}
+	staged := s.staged
+	removals := s.removals
+	failed := s.failed
+	s.staged = make(map[string]string)
+	s.removals = nil
+	s.failed = false
+	s.mu.Unlock()
+	slices.Sort(paths)
+
+	if failed && opts.atomic {
+		for _, path := range paths {
+			os.Remove(staged[path])
+		}
+		if len(paths) > 0 || len(removals) > 0 {
+			opts.logger.Printf("discarded %d generated files and %d removals as the run failed\n", len(paths), len(removals))
+		}
+		s.discardSources()
+		return false
+	}
+
+	for _, path := range paths {
+		err := os.Rename(staged[path], path)
+		if err != nil {
+			os.Remove(staged[path])
+			opts.logger.Printf("failed to write generated file '%s'\nerr: %v\n", path, err)
+			opts.recordError(path, err)
+		}
+	}
+	for _, path := range removals {
+		err := os.Remove(path)
+		if err != nil {
+			opts.logger.Printf("failed to remove orphaned generated file '%s'\nerr: %v\n", path, err)
+			opts.recordError(path, err)
+			continue
+		}
+		opts.logger.Printf("removed orphaned generated file '%s'\n", path)
+	}
+	return true
+}
+
+// discardSources marks the written outputs in the report as discarded.
+func (s *runState) discardSources() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report == nil {
+		return
+	}
+	for i := range s.report.Sources {
+		if s.report.Sources[i].Status == statusWritten {
+			s.report.Sources[i].Status = statusDiscarded
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCommitStaged(t *testing.T) {
+	tests := []struct {
+		name      string
+		sources   map[string]string
+		committed bool
+		// files are those in the directory afterwards, the temporary files
+		// are removed either way
+		files []string
+	}{
+		{
+			name:      "succeeded",
+			sources:   map[string]string{"api.connect.go": pruneSource},
+			committed: true,
+			files:     []string{"api.connect.go", "api.telemetry.go"},
+		},
+		{
+			name: "failed",
+			sources: map[string]string{
+				"api.connect.go":    pruneSource,
+				"broken.connect.go": "package authv1\n\ntype AuthServiceClient interface {\n",
+			},
+			files: []string{"api.connect.go", "broken.connect.go", "old.telemetry.go"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := map[string]string{"old.telemetry.go": generatedFile("old.connect.go")}
+			for name, src := range test.sources {
+				files[name] = src
+			}
+			for name, data := range files {
+				err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts := testOptions()
+			opts.atomic = true
+			opts.prune = true
+			processDir(opts, sourceDir{path: dir})
+			if got := opts.commitStaged(); got != test.committed {
+				t.Errorf("got committed %t, want %t", got, test.committed)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if !slices.Equal(got, test.files) {
+				t.Errorf("got files %v, want %v", got, test.files)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
+)
+
+// cache remembers the outputs generated for sources so that unchanged
+// sources don't have to be parsed again, it is written with -cache.
+type cache struct {
+	mu   sync.Mutex
+	path string
+	// settings is the hash of everything besides the source which the
+	// output depends on, the generator version included.
+	settings string
+	entries  map[string]cacheEntry
+}
+
+// cacheEntry is what is cached for a source, keyed by its path.
+type cacheEntry struct {
+	// Key is the hash of the source and of what it was generated with.
+	Key    string `json:"key"`
+	Output string `json:"output"`
+	// OutputHash is the hash of the generated file, the entry is only used
+	// if the file on disk still has it.
+	OutputHash string          `json:"outputHash"`
+	Services   []listedService `json:"services"`
+}
+
+// hashBytes returns the hex encoded sha256 of data.
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// generatorSettings returns the hash of the settings which change the
+// generated output, besides the sources themselves.
+func generatorSettings(opts options, templatePath string) (string, error) {
+	var templateData []byte
+	if templatePath != "" {
+		var err error
+		templateData, err = os.ReadFile(templatePath)
+		if err != nil {
+			return "", err
+		}
+	}
+	configData, err := json.Marshal(opts.config)
+	if err != nil {
+		return "", err
+	}
+	settings := fmt.Sprintf(
+		"%s\x00%s\x00%s\x00%s\x00%s\x00%o\x00%t",
+		otelgen.Version(), hashBytes(templateData), hashBytes(configData),
+		opts.packageSuffix, opts.sourceImportPath, opts.fileMode, opts.runtime,
+	)
+	return hashBytes([]byte(settings)), nil
+}
+
+// loadCache reads the cache file at path, it starts out empty if the file
+// doesn't exist yet.
+func loadCache(path string, settings string) (*cache, error) {
+	c := &cache{path: path, settings: settings, entries: make(map[string]cacheEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &c.entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse '%s', remove it to start over\nerr: %w", path, err)
+	}
+	return c, nil
+}
+
+// key returns the key of the entry of a source generated to output.
+func (c *cache) key(src []byte, output string, declareShared bool) string {
+	return hashBytes(fmt.Appendf(nil, "%s\x00%s\x00%t\x00%s", c.settings, filepath.Clean(output), declareShared, src))
+}
+
+// lookup returns the services of a source if its output on disk is the one
+// which was generated for the same source and settings, the cache may be nil.
+func (c *cache) lookup(path string, src []byte, output string, declareShared bool) ([]listedService, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[filepath.Clean(path)]
+	c.mu.Unlock()
+	if !ok || entry.Key != c.key(src, output, declareShared) {
+		return nil, false
+	}
+
+	existing, err := os.ReadFile(output)
+	if err != nil || hashBytes(existing) != entry.OutputHash {
+		return nil, false
+	}
+	return entry.Services, true
+}
+
+// store records the output generated for a source, the cache may be nil.
+func (c *cache) store(path string, src []byte, output string, declareShared bool, generated []byte, services []listedService) {
+	if c == nil {
+		return
+	}
+	entry := cacheEntry{
+		Key:        c.key(src, output, declareShared),
+		Output:     filepath.Clean(output),
+		OutputHash: hashBytes(generated),
+		Services:   services,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[filepath.Clean(path)] = entry
+}
+
+// save writes the cache file, the cache may be nil.
+func (c *cache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(c.entries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, buf.Bytes(), 0644)
+}
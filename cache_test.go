@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheLookup(t *testing.T) {
+	src := []byte(pruneSource)
+	generated := []byte(generatedFile("api.connect.go"))
+	tests := []struct {
+		name string
+		// change is applied to the output and the cache after storing the
+		// entry, it returns the source and declareShared to look up
+		change func(t *testing.T, output string, c *cache) ([]byte, bool)
+		hit    bool
+	}{
+		{
+			name: "unchanged",
+			change: func(t *testing.T, output string, c *cache) ([]byte, bool) {
+				return src, true
+			},
+			hit: true,
+		},
+		{
+			name: "output edited",
+			change: func(t *testing.T, output string, c *cache) ([]byte, bool) {
+				err := os.WriteFile(output, append(generated, "// edited\n"...), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return src, true
+			},
+		},
+		{
+			name: "output restored",
+			change: func(t *testing.T, output string, c *cache) ([]byte, bool) {
+				err := os.WriteFile(output, []byte("package authv1\n"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(output, generated, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return src, true
+			},
+			hit: true,
+		},
+		{
+			name: "output removed",
+			change: func(t *testing.T, output string, c *cache) ([]byte, bool) {
+				err := os.Remove(output)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return src, true
+			},
+		},
+		{
+			name: "source changed",
+			change: func(t *testing.T, output string, c *cache) ([]byte, bool) {
+				return append(src, "// changed\n"...), true
+			},
+		},
+		{
+			name: "no longer declaring shared",
+			change: func(t *testing.T, output string, c *cache) ([]byte, bool) {
+				return src, false
+			},
+		},
+		{
+			name: "settings changed",
+			change: func(t *testing.T, output string, c *cache) ([]byte, bool) {
+				c.settings = "other"
+				return src, true
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := filepath.Join(dir, "api.connect.go")
+			output := filepath.Join(dir, "api.telemetry.go")
+			err := os.WriteFile(output, generated, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadCache(filepath.Join(dir, "cache.json"), "settings")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.store(source, src, output, true, generated, []listedService{})
+			// the entry is read back from the file like in the next run
+			err = c.save()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err = loadCache(c.path, c.settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lookupSrc, declareShared := test.change(t, output, c)
+			_, hit := c.lookup(source, lookupSrc, output, declareShared)
+			if hit != test.hit {
+				t.Errorf("got hit %t, want %t", hit, test.hit)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
+)
+
+// commands are the subcommands in the order they are listed in the usage.
+var commands = []string{"generate", "check", "list", "version", "init"}
+
+var commandSummaries = map[string]string{
+	"generate": "generate the instrumentation for the sources matched by the patterns, or for STDIN if there are none",
+	"check":    "compare the instrumentation with the files on disk without writing them, exits with 1 if any are out of date",
+	"list":     "print the services and methods found in the sources",
+	"version":  "print the version of the generator",
+	"init":     "write a starter " + configName,
+}
+
+// usage prints the usage of the program.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: connectrpc-otel-gen <command> [flags] [arguments]\n\n")
+	fmt.Fprintf(out, "commands:\n")
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(writer, "  %s\t%s\n", command, commandSummaries[command])
+	}
+	writer.Flush()
+	fmt.Fprintf(out, "\nwithout a command the arguments are given to generate, run connectrpc-otel-gen <command> -h for the flags of a command\n")
+}
+
+// commandUsage returns the usage function of a command's flag set.
+func commandUsage(flags *flag.FlagSet, command, arguments, summary string) func() {
+	return func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "usage: connectrpc-otel-gen %s %s\n\n%s\n\nflags:\n", command, arguments, summary)
+		flags.PrintDefaults()
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		runGenerate("generate", args)
+		return
+	}
+
+	switch args[0] {
+	case "generate", "check":
+		runGenerate(args[0], args[1:])
+	case "list":
+		runList(args[1:])
+	case "version":
+		runVersion(args[1:])
+	case "init":
+		runInit(args[1:])
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		// invocations from before there were commands
+		runGenerate("generate", args)
+	}
+}
+
+func runVersion(arguments []string) {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	flags.Usage = commandUsage(flags, "version", "", commandSummaries["version"])
+	flags.Parse(arguments)
+
+	fmt.Printf("connectrpc-otel-gen %s\n", otelgen.Version())
+}
+
+// starterConfig is the configuration written by init.
+const starterConfig = `# configuration of connectrpc-otel-gen, paths are relative to this file and
+# flags given on the command line take precedence over it
+
+# patterns generated for when none are given as arguments
+inputs:
+  - ./...
+
+output:
+  # {name} is replaced with the name of the source without its suffix,
+  # _grpc and .twirp are kept (api_grpc.pb.go becomes api_grpc)
+  pattern: "{name}.telemetry.go"
+  # write the instrumentation into a sibling package with this suffix
+  # instead of next to the sources
+  # package_suffix: otel
+  # file_mode: "0644"
+  # call the otelgen/runtime package instead of instrumenting in place
+  # runtime: true
+
+# entries match the full name (ex. services.auth.v1.AuthService) or the name
+# of services with path.Match, later entries take precedence
+services:
+  - name: "*"
+    capture_payloads: true
+    metrics: false
+    # redact: [password]
+    # methods:
+    #   - name: Health*
+    #     skip: true
+`
+
+func runInit(arguments []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	flags.Usage = commandUsage(flags, "init", "[flags]", commandSummaries["init"])
+	output := flags.String("o", configName, "file to write the configuration to")
+	force := flags.Bool("force", false, "overwrite the file if it exists")
+	flags.Parse(arguments)
+
+	if !*force {
+		_, err := os.Stat(*output)
+		if err == nil {
+			log.Fatalf("'%s' already exists, use -force to overwrite it\n", *output)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Fatal(err)
+		}
+	}
+	err := os.WriteFile(*output, []byte(starterConfig), 0644)
+	if err != nil {
+		log.Fatalf("failed to write configuration\nerr: %v\n", err)
+	}
+	log.Printf("wrote %s\n", *output)
+}
+
+// listedService is a service as it is printed by list.
+type listedService struct {
+	Source    string         `json:"source"`
+	Name      string         `json:"name"`
+	FullName  string         `json:"fullName"`
+	Interface string         `json:"interface"`
+	Methods   []listedMethod `json:"methods"`
+}
+
+type listedMethod struct {
+	Name         string `json:"name"`
+	Kind         string `json:"kind"`
+	StreamKind   string `json:"streamKind"`
+	Instrumented bool   `json:"instrumented"`
+}
+
+// listServices converts the services of a source to the services printed by
+// list.
+func listServices(cfg *config, source string, parsed []otelgen.Service) []listedService {
+	var services []listedService
+	for _, s := range parsed {
+		service := listedService{
+			Source:    source,
+			Name:      s.Name,
+			FullName:  s.FullName,
+			Interface: s.QualifiedInterface(),
+			Methods:   []listedMethod{},
+		}
+		for _, m := range s.Methods {
+			service.Methods = append(service.Methods, listedMethod{
+				Name:         m.Name,
+				Kind:         m.Kind.String(),
+				StreamKind:   string(m.StreamKind),
+				Instrumented: !cfg.methodOptions(s.FullName, s.Name, m.Name).Skip,
+			})
+		}
+		services = append(services, service)
+	}
+	return services
+}
+
+func runList(arguments []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	flags.Usage = commandUsage(flags, "list", "[flags] [patterns | .proto files]", commandSummaries["list"])
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	var protoPaths stringsFlag
+	flags.Var(&protoPaths, "proto_path", "directory to search for imports of .proto files in, may be given multiple times (default \".\")")
+	allDirs := flags.Bool("all_dirs", false, "also walk hidden, vendor and testdata directories")
+	configPath := flags.String("config", "", "configuration file, "+configName+" in the working directory or the closest of its parents by default")
+	flags.Parse(arguments)
+
+	cfg := loadProjectConfig(*configPath)
+	args := flags.Args()
+	if len(args) == 0 && cfg != nil {
+		for _, input := range cfg.Inputs {
+			args = append(args, cfg.resolve(input))
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	opts := options{logger: log.Default(), state: &runState{}}
+	var protoFiles, patterns []string
+	for _, arg := range args {
+		if strings.HasSuffix(arg, ".proto") {
+			protoFiles = append(protoFiles, arg)
+			continue
+		}
+		patterns = append(patterns, arg)
+	}
+
+	services := []listedService{}
+	for _, dir := range resolvePatterns(opts, patterns, *allDirs) {
+		entries, err := os.ReadDir(dir.path)
+		if err != nil {
+			log.Printf("failed to read directory '%s'\nerr: %v\n", dir.path, err)
+			continue
+		}
+		for _, e := range entries {
+			if _, ok := opts.outputName(e.Name()); !ok || e.IsDir() {
+				continue
+			}
+			if dir.files != nil && !slices.Contains(dir.files, e.Name()) {
+				continue
+			}
+			path := filepath.Join(dir.path, e.Name())
+			src, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("failed to read source '%s'\nerr: %v\n", path, err)
+				continue
+			}
+			parsed, err := otelgen.Parse(src, otelgen.Options{Filename: path})
+			if errors.Is(err, otelgen.ErrNoInterfaces) {
+				continue
+			}
+			if err != nil {
+				log.Printf("failed to parse source '%s'\nerr: %v\n", path, err)
+				continue
+			}
+			services = append(services, listServices(cfg, path, parsed)...)
+		}
+	}
+
+	if len(protoFiles) > 0 {
+		importPaths := []string(protoPaths)
+		if len(importPaths) == 0 {
+			importPaths = []string{"."}
+		}
+		files, sources, err := compileProtoFiles(protoFiles, importPaths)
+		if err != nil {
+			log.Fatalf("failed to compile proto files\nerr: %v\n", err)
+		}
+		for _, file := range files {
+			_, parsed, err := parseProtoServices(file, "")
+			if err != nil {
+				log.Printf("failed to list services of '%s'\nerr: %v\n", file.Path(), err)
+				continue
+			}
+			services = append(services, listServices(cfg, sources[file.Path()], parsed)...)
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(services)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "SOURCE\tSERVICE\tINTERFACE\tMETHOD\tKIND\tSTREAM\tINSTRUMENTED")
+	for _, service := range services {
+		name := service.FullName
+		if name == "" {
+			name = service.Name
+		}
+		for _, m := range service.Methods {
+			fmt.Fprintf(
+				writer, "%s\t%s\t%s\t%s\t%s\t%s\t%t\n",
+				service.Source, name, service.Interface, m.Name, m.Kind, m.StreamKind, m.Instrumented,
+			)
+		}
+	}
+	writer.Flush()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
+	"gopkg.in/yaml.v3"
+)
+
+// configName is the name of the configuration file, it is looked for in the
+// working directory and then in each of its parents.
+const configName = "connectrpc-otel-gen.yaml"
+
+// config is the project configuration, paths in it are relative to the
+// directory of the file.
+type config struct {
+	// Inputs are the patterns generated for when none are given as
+	// arguments.
+	Inputs   []string     `yaml:"inputs"`
+	Output   outputConfig `yaml:"output"`
+	Template string       `yaml:"template"`
+	// Cache is the file sources and their outputs are cached in, see -cache.
+	Cache string `yaml:"cache"`
+	// Services configure the instrumentation of the services matching them,
+	// later entries take precedence over earlier ones.
+	Services []serviceConfig `yaml:"services"`
+
+	// dir is the directory of the file the configuration was read from.
+	dir string
+}
+
+type outputConfig struct {
+	Pattern          string `yaml:"pattern"`
+	Dir              string `yaml:"dir"`
+	FileMode         string `yaml:"file_mode"`
+	PackageSuffix    string `yaml:"package_suffix"`
+	SourceImportPath string `yaml:"source_import_path"`
+	// Runtime generates the wrappers with the otelgen/runtime package, see
+	// -runtime.
+	Runtime bool `yaml:"runtime"`
+}
+
+// instrumentationConfig are the options which can be set for services and
+// methods, see otelgen.MethodOptions. Unset options are inherited and
+// Redact adds up with the fields of the matching entries.
+type instrumentationConfig struct {
+	Skip            *bool    `yaml:"skip"`
+	CapturePayloads *bool    `yaml:"capture_payloads"`
+	Redact          []string `yaml:"redact"`
+	Metrics         *bool    `yaml:"metrics"`
+}
+
+type serviceConfig struct {
+	// Name is matched with path.Match against the full name of services
+	// (ex. services.auth.v1.*) and their name (ex. AuthService).
+	Name                  string `yaml:"name"`
+	instrumentationConfig `yaml:",inline"`
+	Methods               []methodConfig `yaml:"methods"`
+}
+
+type methodConfig struct {
+	// Name is matched with path.Match against the name of methods.
+	Name                  string `yaml:"name"`
+	instrumentationConfig `yaml:",inline"`
+}
+
+// findConfig returns the path of the configuration file closest to dir, it
+// is empty if there is none.
+func findConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, configName)
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// loadConfig reads the configuration file, unknown keys are an error.
+func loadConfig(filename string) (*config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &config{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse '%s'\nerr: %w", filename, err)
+	}
+
+	for _, service := range cfg.Services {
+		_, err := path.Match(service.Name, "")
+		if service.Name == "" || err != nil {
+			return nil, fmt.Errorf("'%s': invalid service name pattern '%s'", filename, service.Name)
+		}
+		for _, method := range service.Methods {
+			_, err := path.Match(method.Name, "")
+			if method.Name == "" || err != nil {
+				return nil, fmt.Errorf("'%s': invalid method name pattern '%s' in service '%s'", filename, method.Name, service.Name)
+			}
+		}
+	}
+
+	cfg.dir = filepath.Dir(filename)
+	return cfg, nil
+}
+
+// loadProjectConfig loads the configuration file at path, or the one found
+// from the working directory if path is empty. It returns nil if there is
+// none and exits if it can't be loaded.
+func loadProjectConfig(path string) *config {
+	if path == "" {
+		found, err := findConfig(".")
+		if err != nil {
+			log.Fatalf("failed to look for %s\nerr: %v\n", configName, err)
+		}
+		if found == "" {
+			return nil
+		}
+		path = found
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		log.Fatalf("failed to load configuration\nerr: %v\n", err)
+	}
+	return cfg
+}
+
+// resolve returns a path of the configuration relative to the working
+// directory.
+func (c *config) resolve(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.dir, p)
+}
+
+// apply overrides the options with those set in the configuration.
+func (cfg instrumentationConfig) apply(o *otelgen.MethodOptions) {
+	if cfg.Skip != nil {
+		o.Skip = *cfg.Skip
+	}
+	if cfg.CapturePayloads != nil {
+		o.CapturePayloads = *cfg.CapturePayloads
+	}
+	for _, field := range cfg.Redact {
+		if !slices.Contains(o.Redact, field) {
+			o.Redact = append(o.Redact, field)
+		}
+	}
+	if cfg.Metrics != nil {
+		o.Metrics = *cfg.Metrics
+	}
+}
+
+// methodOptions returns the options of a method, the configuration may be
+// nil in which case the defaults are returned.
+func (c *config) methodOptions(serviceFullName, serviceName, method string) otelgen.MethodOptions {
+	opts := otelgen.DefaultMethodOptions
+	if c == nil {
+		return opts
+	}
+	for _, service := range c.Services {
+		if !matchName(service.Name, serviceFullName) && !matchName(service.Name, serviceName) {
+			continue
+		}
+		service.apply(&opts)
+		for _, m := range service.Methods {
+			if matchName(m.Name, method) {
+				m.apply(&opts)
+			}
+		}
+	}
+	return opts
+}
+
+// matchName reports whether a name matches a pattern of the configuration.
+func matchName(pattern, name string) bool {
+	if name == "" {
+		return false
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
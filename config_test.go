@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
+)
+
+const testConfig = `services:
+  - name: services.*
+    metrics: true
+    redact: [password]
+    methods:
+      - name: Start*
+        capture_payloads: false
+        redact: [token]
+  - name: AuthService
+    metrics: false
+    redact: [password, secret]
+    methods:
+      - name: StartLogin
+        capture_payloads: true
+      - name: Health*
+        skip: true
+`
+
+func TestMethodOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), configName)
+	err := os.WriteFile(path, []byte(testConfig), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fullName string
+		service  string
+		method   string
+		want     otelgen.MethodOptions
+	}{
+		{
+			fullName: "services.auth.v1.AuthService",
+			service:  "AuthService",
+			method:   "StartLogin",
+			want:     otelgen.MethodOptions{CapturePayloads: true, Redact: []string{"password", "token", "secret"}},
+		},
+		{
+			fullName: "services.auth.v1.AuthService",
+			service:  "AuthService",
+			method:   "StartSignup",
+			want:     otelgen.MethodOptions{Redact: []string{"password", "token", "secret"}},
+		},
+		{
+			fullName: "services.auth.v1.AuthService",
+			service:  "AuthService",
+			method:   "HealthCheck",
+			want:     otelgen.MethodOptions{Skip: true, CapturePayloads: true, Redact: []string{"password", "secret"}},
+		},
+		{
+			fullName: "services.admin.v1.AdminService",
+			service:  "AdminService",
+			method:   "StartLogin",
+			want:     otelgen.MethodOptions{Metrics: true, Redact: []string{"password", "token"}},
+		},
+		{
+			fullName: "other.v1.OtherService",
+			service:  "OtherService",
+			method:   "StartLogin",
+			want:     otelgen.DefaultMethodOptions,
+		},
+	}
+	for _, test := range tests {
+		got := cfg.methodOptions(test.fullName, test.service, test.method)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("got options %+v for %s.%s, want %+v", got, test.fullName, test.method, test.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// edit is a line of a diff, op is one of ' ', '-' or '+'.
+type edit struct {
+	op   byte
+	line string
+}
+
+// noNewline is appended to the last line of a text which doesn't end with a
+// newline, it makes the line differ from the same line with a newline and is
+// printed on its own line like diff -u does.
+const noNewline = "\n\\ No newline at end of file"
+
+// splitLines splits text into lines without their line endings.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if !strings.HasSuffix(text, "\n") {
+		lines[len(lines)-1] += noNewline
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script turning a into b, computed with
+// the algorithm described in Myers' "An O(ND) Difference Algorithm and Its
+// Variations".
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	limit := n + m
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace keeps the diagonals which can be reached before each step,
+	// those of step d range from -d-1 to d+1
+	var trace [][]int
+
+search:
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// walk the furthest reaching paths back from the end
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k] < v[d+k+2]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+1+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{op: ' ', line: a[x]})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			edits = append(edits, edit{op: '+', line: b[y]})
+		} else {
+			x--
+			edits = append(edits, edit{op: '-', line: a[x]})
+		}
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// hunkRange formats the range of a side of a hunk, empty ranges refer to the
+// line before them.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// unifiedDiff returns the differences between two texts in the unified
+// format, it is empty if they are the same.
+func unifiedDiff(oldName, newName, oldText, newText string) string {
+	edits := diffLines(splitLines(oldText), splitLines(newText))
+
+	var builder strings.Builder
+	// line numbers of the start of each edit
+	oldLines := make([]int, len(edits)+1)
+	newLines := make([]int, len(edits)+1)
+	for i, e := range edits {
+		oldLines[i+1], newLines[i+1] = oldLines[i], newLines[i]
+		if e.op != '+' {
+			oldLines[i+1]++
+		}
+		if e.op != '-' {
+			newLines[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+
+		// a hunk extends until a change is followed by more unchanged lines
+		// than the context on both sides of it
+		start := max(i-diffContext, 0)
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].op != ' ' {
+				end = j + 1
+				continue
+			}
+			if j-end >= 2*diffContext {
+				break
+			}
+		}
+		end = min(end+diffContext, len(edits))
+
+		if builder.Len() == 0 {
+			builder.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", oldName, newName))
+		}
+		builder.WriteString(fmt.Sprintf(
+			"@@ -%s +%s @@\n",
+			hunkRange(oldLines[start], oldLines[end]-oldLines[start]),
+			hunkRange(newLines[start], newLines[end]-newLines[start]),
+		))
+		for _, e := range edits[start:end] {
+			builder.WriteByte(e.op)
+			builder.WriteString(e.line)
+			builder.WriteByte('\n')
+		}
+		i = end
+	}
+	return builder.String()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// numberedLines returns the lines 1 to n, with the lines in replace
+// substituted.
+func numberedLines(n int, replace map[int]string) string {
+	var builder strings.Builder
+	for i := 1; i <= n; i++ {
+		line, ok := replace[i]
+		if !ok {
+			line = fmt.Sprint(i)
+		}
+		builder.WriteString(line + "\n")
+	}
+	return builder.String()
+}
+
+// the expected outputs are those of GNU diff -u
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		oldName string
+		oldText string
+		newText string
+		want    string
+	}{
+		{
+			name:    "unchanged",
+			oldName: "a/f",
+			oldText: numberedLines(20, nil),
+			newText: numberedLines(20, nil),
+			want:    "",
+		},
+		{
+			name:    "separate hunks",
+			oldName: "a/f",
+			oldText: numberedLines(20, nil),
+			newText: numberedLines(20, map[int]string{5: "five", 17: "seventeen"}),
+			want: `--- a/f
++++ b/f
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+@@ -14,7 +14,7 @@
+ 14
+ 15
+ 16
+-17
++seventeen
+ 18
+ 19
+ 20
+`,
+		},
+		{
+			name:    "merged hunks",
+			oldName: "a/f",
+			oldText: numberedLines(20, nil),
+			newText: numberedLines(20, map[int]string{5: "five", 11: "eleven"}),
+			want: `--- a/f
++++ b/f
+@@ -2,13 +2,13 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+ 9
+ 10
+-11
++eleven
+ 12
+ 13
+ 14
+`,
+		},
+		{
+			name:    "missing newline",
+			oldName: "a/f",
+			oldText: "x\ny",
+			newText: "x\ny\n",
+			want: `--- a/f
++++ b/f
+@@ -1,2 +1,2 @@
+ x
+-y
+\ No newline at end of file
++y
+`,
+		},
+		{
+			name:    "missing file",
+			oldName: "/dev/null",
+			oldText: "",
+			newText: "one\ntwo\n",
+			want: `--- /dev/null
++++ b/f
+@@ -0,0 +1,2 @@
++one
++two
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := unifiedDiff(test.oldName, "b/f", test.oldText, test.newText)
+			if got != test.want {
+				t.Errorf("got diff\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
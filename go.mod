@@ -1,3 +1,20 @@
 module github.com/LQR471814/connectrpc-otel-gen
 
 go 1.22.2
+
+require (
+	connectrpc.com/connect v1.18.1
+	github.com/bufbuild/protocompile v0.14.1
+	go.opentelemetry.io/otel v1.35.0
+	go.opentelemetry.io/otel/metric v1.35.0
+	go.opentelemetry.io/otel/trace v1.35.0
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+)
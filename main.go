@@ -1,80 +1,821 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
-	"go/parser"
-	"go/token"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
 )
 
-func processFile(filename string, input io.Reader) string {
-	src, err := io.ReadAll(input)
+// sourceSuffixes are the suffixes of the files generated by the supported
+// protoc plugins, along with the part of them kept in {name} so that sources
+// of different frameworks (ex. api.twirp.go and api_grpc.pb.go) don't share
+// an output.
+var sourceSuffixes = []struct{ suffix, kept string }{
+	{suffix: ".connect.go"},
+	{suffix: "_grpc.pb.go", kept: "_grpc"},
+	{suffix: ".twirp.go", kept: ".twirp"},
+}
+
+// defaultOutputPattern is the name of the generated files, {name} is replaced
+// with the name of the source without its suffix (api for api.connect.go,
+// api_grpc for api_grpc.pb.go and api.twirp for api.twirp.go).
+const defaultOutputPattern = "{name}.telemetry.go"
+
+// validateOutputPattern checks that an output pattern names a go file in the
+// output directory which differs for each source.
+func validateOutputPattern(pattern string) error {
+	if !strings.Contains(pattern, "{name}") {
+		return fmt.Errorf("output pattern '%s' does not contain {name}", pattern)
+	}
+	if strings.ContainsAny(pattern, `/\`) {
+		return fmt.Errorf("output pattern '%s' must be a file name, use -output_dir to change the directory", pattern)
+	}
+	if !strings.HasSuffix(pattern, ".go") || strings.HasSuffix(pattern, "_test.go") {
+		return fmt.Errorf("output pattern '%s' must end with .go and not _test.go", pattern)
+	}
+	return nil
+}
+
+// options are the settings shared by every file processed in a run.
+type options struct {
+	templates *template.Template
+	// config holds the options of the services and methods, it is nil if
+	// there is no configuration file.
+	config *config
+	// packageSuffix is appended to the name and directory of the package of
+	// a source to get the package the instrumentation is written to, it is
+	// written next to the source if empty.
+	packageSuffix string
+	// sourceImportPath is the import path of the package of the sources, it
+	// is resolved from the enclosing go.mod if empty.
+	sourceImportPath string
+	// outputPattern is the name of the generated files, see
+	// defaultOutputPattern.
+	outputPattern string
+	// outputRoot is the directory the output is written to, mirroring the
+	// layout of the sources, it is written next to them if empty.
+	outputRoot string
+	// fileMode is the permissions of the generated files, those of the
+	// source are preserved if zero.
+	fileMode os.FileMode
+	// check compares the generated files with those on disk instead of
+	// writing them.
+	check bool
+	// prune removes generated files whose source no longer exists.
+	prune bool
+	// atomic stages the generated files and the removals of orphaned ones
+	// until the end of the run, they are only applied if nothing failed.
+	atomic bool
+	// jobs is the number of directories processed concurrently.
+	jobs int
+	// logger and stdout are where diagnostics and diffs are written, they
+	// are buffered per directory when processing concurrently.
+	logger *log.Logger
+	stdout io.Writer
+	state  *runState
+	// cache skips parsing the sources whose outputs are up to date, it is
+	// nil without -cache.
+	cache *cache
+	// runtime generates wrappers which call the otelgen/runtime package.
+	runtime bool
+}
+
+// runState is what is recorded over a run, it is shared by the directories
+// processed concurrently.
+type runState struct {
+	mu sync.Mutex
+	// stale is set in check mode if any generated file differs from the
+	// one on disk.
+	stale bool
+	// outputs are the paths of the files generated by the run.
+	outputs map[string]bool
+	// failed is set if anything couldn't be generated, written or removed.
+	failed bool
+	// staged are the temporary files written with -atomic keyed by the
+	// path they are renamed to, removals are the orphaned files to remove.
+	staged   map[string]string
+	removals []string
+	// report is what is written to reportPath, it is nil without -report.
+	report     *report
+	reportPath string
+}
+
+func (s *runState) markStale() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stale = true
+}
+
+func (s *runState) isStale() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stale
+}
+
+func (s *runState) addOutput(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outputs[filepath.Clean(path)] = true
+}
+
+func (s *runState) hasOutput(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.outputs[filepath.Clean(path)]
+}
+
+// outputName returns the name of the telemetry file generated for a source
+// file, the boolean is false if the file isn't a source.
+func (opts options) outputName(name string) (string, bool) {
+	for _, s := range sourceSuffixes {
+		if strings.HasSuffix(name, s.suffix) {
+			return opts.outputFileName(strings.TrimSuffix(name, s.suffix) + s.kept), true
+		}
+	}
+	return "", false
+}
+
+// duplicateOutputError is the error of a source whose output is the same as
+// that of another source.
+func duplicateOutputError(other string, output string) error {
+	return fmt.Errorf("its output '%s' is the same as that of '%s', rename one of them", output, other)
+}
+
+// outputFileName applies the output pattern to the name of a source without
+// its suffix.
+func (opts options) outputFileName(base string) string {
+	pattern := opts.outputPattern
+	if pattern == "" {
+		pattern = defaultOutputPattern
+	}
+	return strings.ReplaceAll(pattern, "{name}", base)
+}
+
+// outputDir returns the directory the instrumentation for the sources in dir
+// is written to.
+func (opts options) outputDir(dir string) string {
+	if opts.packageSuffix != "" {
+		dir = filepath.Clean(dir)
+		if dir == "." {
+			abs, err := filepath.Abs(dir)
+			if err == nil {
+				dir = abs
+			}
+		}
+		dir = filepath.Join(filepath.Dir(dir), filepath.Base(dir)+opts.packageSuffix)
+	}
+	return opts.mirror(dir)
+}
+
+// mirror returns where a directory is placed under the output root, the path
+// relative to the working directory is kept unless it is outside of it, in
+// which case the directory is placed directly under the root.
+func (opts options) mirror(dir string) string {
+	if opts.outputRoot == "" {
+		return dir
+	}
+	rel := dir
+	if filepath.IsAbs(dir) || strings.HasPrefix(filepath.Clean(dir), "..") {
+		rel = filepath.Base(dir)
+		wd, err := os.Getwd()
+		if err == nil {
+			abs, err := filepath.Abs(dir)
+			if err == nil {
+				r, err := filepath.Rel(wd, abs)
+				if err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+					rel = r
+				}
+			}
+		}
+	}
+	return filepath.Join(opts.outputRoot, rel)
+}
+
+// writeOutput writes a generated file, creating its directory if needed. The
+// file gets the configured permissions or those of the source, directories
+// are created searchable by whoever can read the file. It returns the status
+// of the output for the report.
+func (opts options) writeOutput(path string, generated []byte, source string) (string, error) {
+	opts.state.addOutput(path)
+	if opts.check {
+		return opts.checkOutput(path, generated)
+	}
+
+	mode := opts.fileMode
+	if mode == 0 {
+		info, err := os.Stat(source)
+		if err != nil {
+			return "", err
+		}
+		mode = info.Mode().Perm()
+	}
+
+	// rewriting an identical file would only bump its modification time,
+	// invalidating build caches
+	existing, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(existing, generated) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode().Perm() != mode {
+			return statusUnchanged, os.Chmod(path, mode)
+		}
+		return statusUnchanged, nil
+	}
+
+	err = mkdirAll(filepath.Dir(path), mode|(mode&0444)>>2|0700)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	if !opts.atomic {
+		return statusWritten, writeFileAtomic(path, generated, mode)
+	}
+	temp, err := writeTemp(path, generated, mode)
+	if err != nil {
+		return "", err
 	}
+	opts.state.stage(path, temp)
+	return statusWritten, nil
+}
 
-	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, filename, string(src), parser.SkipObjectResolution)
+// processFile generates the instrumentation for a source file, declareShared
+// is passed on as otelgen.Options.DeclareShared. The services found in the
+// source are returned along with otelgen.ErrNoServices.
+func processFile(opts options, filename string, input io.Reader, declareShared bool) (string, []otelgen.Service, error) {
+	src, err := io.ReadAll(input)
 	if err != nil {
-		log.Fatal(err)
+		return "", nil, err
+	}
+
+	// generating into a separate package requires qualifying the types
+	// declared in the source and importing its package
+	importPath := ""
+	if opts.packageSuffix != "" {
+		importPath = opts.sourceImportPath
+		if importPath == "" {
+			if filename == "STDIN" {
+				return "", nil, errors.New("-source_import_path is required to generate into a separate package from STDIN")
+			}
+			importPath, err = resolveImportPath(filepath.Dir(filename))
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to resolve the import path of '%s', set it with -source_import_path\nerr: %w", filename, err)
+			}
+		}
 	}
 
-	targets := parseTargets(file)
-	if targets == nil {
-		log.Fatal("could not find connectrpc client interface")
+	services, err := otelgen.Parse(src, otelgen.Options{Filename: filename, SourceImportPath: importPath})
+	if err != nil {
+		return "", nil, err
 	}
 
-	return generate(file, targets)
+	source := ""
+	if filename != "STDIN" {
+		source = filepath.Base(filename)
+	}
+	generated, err := otelgen.Generate(services, otelgen.Options{
+		Package:       services[0].Package + opts.packageSuffix,
+		Source:        source,
+		DeclareShared: declareShared,
+		Templates:     opts.templates,
+		MethodOptions: opts.config.methodOptions,
+		Runtime:       opts.runtime,
+	})
+	if err != nil {
+		return "", services, err
+	}
+	return string(generated), services, nil
 }
 
-func processFilesRecursively(dir string) {
+// processDir generates the instrumentation for the sources directly in a
+// directory, returning the number of files generated.
+func processDir(opts options, source sourceDir) int {
+	dir := source.path
+	// the outputs of a directory which was removed are still pruned
 	entries, err := os.ReadDir(dir)
-	if err != nil {
-		log.Printf("failed to read directory '%s'\nerr: %v\n", dir, err)
-		return
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		opts.logger.Printf("failed to read directory '%s'\nerr: %v\n", dir, err)
+		opts.recordError(dir, err)
+		return 0
 	}
 
+	// the first source of the directory declares what is shared, even if it
+	// isn't one of the files generated for
+	count := 0
+	outputs := make(map[string]bool)
+	// skipped holds the sources whose services are all skipped, their outputs
+	// are pruned even though they still exist
+	skipped := make(map[string]bool)
+	// sources of different frameworks can still map to the same output (ex.
+	// api_grpc.pb.go and api_grpc.connect.go), claimed holds the first source
+	// of each
+	claimed := make(map[string]string)
+	first := true
 	for _, e := range entries {
-		path := filepath.Join(dir, e.Name())
 		if e.IsDir() {
-			processFilesRecursively(path)
 			continue
 		}
-		if e.Name() != "api.connect.go" {
+		output, ok := opts.outputName(e.Name())
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		outputPath := filepath.Join(opts.outputDir(dir), output)
+		outputs[outputPath] = true
+		if other, ok := claimed[outputPath]; ok {
+			err := duplicateOutputError(other, outputPath)
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", path, err)
+			opts.recordError(path, err)
+			opts.recordSource(path, outputPath, statusFailed, nil, time.Now())
+			continue
+		}
+		claimed[outputPath] = path
+		declareShared := first
+		first = false
+		if source.files != nil && !slices.Contains(source.files, e.Name()) {
 			continue
 		}
 
-		f, err := os.Open(path)
+		start := time.Now()
+		src, err := os.ReadFile(path)
+		if err != nil {
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", path, err)
+			opts.recordError(path, err)
+			opts.recordSource(path, outputPath, statusFailed, nil, start)
+			continue
+		}
+		if services, ok := opts.cache.lookup(path, src, outputPath, declareShared); ok {
+			opts.state.addOutput(outputPath)
+			opts.recordCachedSource(path, outputPath, services, start)
+			count++
+			continue
+		}
+		generated, services, err := processFile(opts, path, bytes.NewReader(src), declareShared)
+		if errors.Is(err, otelgen.ErrNoServices) {
+			// an output left from before the services were skipped is pruned
+			delete(outputs, outputPath)
+			skipped[e.Name()] = true
+			opts.recordSource(path, "", statusSkipped, services, start)
+			continue
+		}
 		if err != nil {
-			log.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", dir, err)
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", path, err)
+			opts.recordError(path, err)
+			opts.recordSource(path, outputPath, statusFailed, services, start)
 			continue
 		}
-		generated := processFile(path, f)
-		f.Close()
 
-		err = os.WriteFile(filepath.Join(dir, "api.telemetry.go"), []byte(generated), 0600)
+		status, err := opts.writeOutput(outputPath, []byte(generated), path)
 		if err != nil {
-			log.Printf("failed to write generated code for source '%s'\nerr: %v\n", dir, err)
+			opts.logger.Printf("failed to write generated code for source '%s'\nerr: %v\n", path, err)
+			opts.recordError(outputPath, err)
+			opts.recordSource(path, outputPath, statusFailed, services, start)
+			continue
 		}
-		return
+		opts.recordSource(path, outputPath, status, services, start)
+		if status != statusStale {
+			opts.cache.store(path, src, outputPath, declareShared, []byte(generated), listServices(opts.config, path, services))
+		}
+		count++
 	}
+
+	if opts.prune {
+		// files written by other runs (ex. with -file and -o) are kept as
+		// long as the source in their header exists
+		opts.pruneDir(opts.outputDir(dir), func(path, source string) bool {
+			if outputs[path] {
+				return false
+			}
+			if source == "" || skipped[source] {
+				return true
+			}
+			_, err := os.Stat(filepath.Join(dir, source))
+			return errors.Is(err, fs.ErrNotExist)
+		})
+		// the sibling package of a source directory which was removed
+		// entirely isn't the output of any directory left
+		if opts.packageSuffix != "" && strings.HasSuffix(filepath.Base(dir), opts.packageSuffix) && opts.outputRoot == "" {
+			sourceDir := strings.TrimSuffix(filepath.Clean(dir), opts.packageSuffix)
+			_, err := os.Stat(sourceDir)
+			if errors.Is(err, fs.ErrNotExist) {
+				opts.pruneDir(dir, func(path, source string) bool {
+					return true
+				})
+			}
+		}
+	}
+	return count
 }
 
-func main() {
-	flag.Parse()
-	directories := flag.Args()
+// declaresShared returns whether a source is the first of the sources in its
+// directory, which is the one declaring what is shared by their outputs.
+func declaresShared(opts options, path string) bool {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return true
+	}
+	name := filepath.Base(path)
+	for _, e := range entries {
+		if _, ok := opts.outputName(e.Name()); ok && !e.IsDir() {
+			return e.Name() >= name
+		}
+	}
+	return true
+}
+
+// processSingleFile generates the instrumentation for one source, writing it
+// to output or next to the source if output is empty.
+func processSingleFile(opts options, path string, output string) error {
+	if output == "" {
+		name, ok := opts.outputName(filepath.Base(path))
+		if !ok {
+			return fmt.Errorf("'%s' is not a connect, grpc or twirp source, set where to write its instrumentation with -o", path)
+		}
+		output = filepath.Join(opts.outputDir(filepath.Dir(path)), name)
+	}
 
-	if len(directories) == 0 {
-		generated := processFile("STDIN", os.Stdin)
+	start := time.Now()
+	src, err := os.ReadFile(path)
+	if err != nil {
+		opts.recordSource(path, output, statusFailed, nil, start)
+		return err
+	}
+	declareShared := declaresShared(opts, path)
+	if services, ok := opts.cache.lookup(path, src, output, declareShared); ok {
+		opts.state.addOutput(output)
+		opts.recordCachedSource(path, output, services, start)
+		return nil
+	}
+	generated, services, err := processFile(opts, path, bytes.NewReader(src), declareShared)
+	if errors.Is(err, otelgen.ErrNoServices) {
+		opts.logger.Printf("nothing to generate for source '%s', %v\n", path, err)
+		opts.recordSource(path, "", statusSkipped, services, start)
+		return nil
+	}
+	if err != nil {
+		opts.recordSource(path, output, statusFailed, services, start)
+		return err
+	}
+	status, err := opts.writeOutput(output, []byte(generated), path)
+	if err != nil {
+		status = statusFailed
+	}
+	opts.recordSource(path, output, status, services, start)
+	if err == nil && status != statusStale {
+		opts.cache.store(path, src, output, declareShared, []byte(generated), listServices(opts.config, path, services))
+	}
+	return err
+}
+
+// processDirs runs processDir for the given directories with up to opts.jobs
+// of them processed at once, returning the number of files generated for
+// each. What they log is written in the order of the directories.
+func processDirs(opts options, dirs []sourceDir) []int {
+	type result struct {
+		count  int
+		logs   bytes.Buffer
+		stdout bytes.Buffer
+		done   chan struct{}
+	}
+	results := make([]*result, len(dirs))
+	for i := range results {
+		results[i] = &result{done: make(chan struct{})}
+	}
+
+	queue := make(chan int)
+	go func() {
+		for i := range dirs {
+			queue <- i
+		}
+		close(queue)
+	}()
+	for w := 0; w < max(opts.jobs, 1); w++ {
+		go func() {
+			for i := range queue {
+				r := results[i]
+				dirOpts := opts
+				dirOpts.logger = log.New(&r.logs, opts.logger.Prefix(), opts.logger.Flags())
+				dirOpts.stdout = &r.stdout
+				r.count = processDir(dirOpts, dirs[i])
+				close(r.done)
+			}
+		}()
+	}
+
+	counts := make([]int, len(dirs))
+	for i, r := range results {
+		<-r.done
+		opts.stdout.Write(r.stdout.Bytes())
+		opts.logger.Writer().Write(r.logs.Bytes())
+		counts[i] = r.count
+	}
+	return counts
+}
+
+// checkOutput prints the diff between a generated file and the one on disk,
+// marking the run as stale if they differ.
+func (opts options) checkOutput(path string, generated []byte) (string, error) {
+	existing, err := os.ReadFile(path)
+	oldName := "a/" + filepath.ToSlash(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		oldName = "/dev/null"
+	} else if err != nil {
+		return "", err
+	} else if bytes.Equal(existing, generated) {
+		return statusUnchanged, nil
+	}
+
+	diff := unifiedDiff(oldName, "b/"+filepath.ToSlash(path), string(existing), string(generated))
+	if diff == "" {
+		return statusUnchanged, nil
+	}
+	opts.state.markStale()
+	fmt.Fprint(opts.stdout, diff)
+	return statusStale, nil
+}
+
+// saveCache writes the cache if there is one, logging if it can't be.
+func (opts options) saveCache() {
+	err := opts.cache.save()
+	if err != nil {
+		opts.logger.Printf("failed to write cache '%s'\nerr: %v\n", opts.cache.path, err)
+	}
+}
+
+// mkdirAll is os.MkdirAll except that the directories it creates get the
+// given permissions regardless of the umask, existing ones are left as is.
+func mkdirAll(dir string, mode os.FileMode) error {
+	_, err := os.Stat(dir)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		err = mkdirAll(parent, mode)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Mkdir(dir, mode)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
+
+// stringsFlag is a flag that can be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runGenerate runs the generate command, or the check command which is the
+// same with -check always set.
+func runGenerate(command string, arguments []string) {
+	start := time.Now()
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.Usage = commandUsage(flags, command, "[flags] [patterns | .proto files]", commandSummaries[command])
+
+	var protoPaths stringsFlag
+	flags.Var(&protoPaths, "proto_path", "directory to search for imports of .proto files in, may be given multiple times (default \".\")")
+	protoOut := flags.String("proto_out", ".", "directory to write the instrumentation generated from .proto files to")
+	templatePath := flags.String("template", "", "text/template file redefining the templates the wrappers are generated with")
+	packageSuffix := flags.String("package_suffix", "", "write the instrumentation into a sibling package named after the source package with this suffix (ex. \"otel\" for authv1connectotel) instead of next to the source")
+	sourceImportPath := flags.String("source_import_path", "", "import path of the source package when using -package_suffix, resolved from the enclosing go.mod by default")
+	outputPattern := flags.String("output_pattern", defaultOutputPattern, "name of the generated files, {name} is replaced with the name of the source without its suffix, keeping _grpc and .twirp")
+	outputRoot := flags.String("output_dir", "", "directory to write the generated files to, mirroring the layout of the sources, instead of next to them")
+	check := new(bool)
+	if command == "check" {
+		*check = true
+	} else {
+		flags.BoolVar(check, "check", false, "compare the generated files with those on disk and print a diff instead of writing them, exits with 1 if any are out of date or missing")
+	}
+	watchMode := flags.Bool("watch", false, "keep running after generating and regenerate the instrumentation of directories whose sources change")
+	watchInterval := flags.Duration("watch_interval", time.Second, "how often to poll for changes with -watch")
+	file := flags.String("file", "", "generate the instrumentation for only this source, for use with //go:generate as -file $GOFILE")
+	output := flags.String("o", "", "file to write the instrumentation generated with -file to, named after the source by default")
+	allDirs := flags.Bool("all_dirs", false, "also walk hidden, vendor and testdata directories")
+	jobs := flags.Int("j", runtime.NumCPU(), "number of directories to generate for concurrently")
+	prune := flags.Bool("prune", false, "remove generated files whose source no longer exists, with -check they are reported instead")
+	fileMode := flags.String("file_mode", "", "octal permissions of the generated files (ex. 0644), those of the source are preserved by default")
+	configPath := flags.String("config", "", "configuration file, "+configName+" in the working directory or the closest of its parents by default")
+	txtar := flags.Bool("txtar", false, "read a txtar archive of sources from STDIN and print a txtar archive of the generated files, at the paths they would be written to")
+	atomic := flags.Bool("atomic", false, "only write the generated files and remove orphaned ones if nothing fails, exits with 1 otherwise")
+	cachePath := flags.String("cache", "", "file to cache the hashes of sources and their outputs in, sources which haven't changed since they were generated aren't parsed again")
+	useRuntime := flags.Bool("runtime", false, "generate thin wrappers calling the otelgen/runtime package, which the generated code then depends on, instead of instrumenting the calls themselves")
+	reportPath := flags.String("report", "", "file to write a JSON report of the sources processed, the services found in them, what happened to their outputs and the diagnostics of the run to")
+	flags.Parse(arguments)
+
+	cfg := loadProjectConfig(*configPath)
+
+	// flags given on the command line take precedence over the configuration
+	args := flags.Args()
+	if cfg != nil {
+		set := make(map[string]bool)
+		flags.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+		override := func(name string, value *string, configured string) {
+			if !set[name] && configured != "" {
+				*value = configured
+			}
+		}
+		override("template", templatePath, cfg.resolve(cfg.Template))
+		override("output_pattern", outputPattern, cfg.Output.Pattern)
+		override("output_dir", outputRoot, cfg.resolve(cfg.Output.Dir))
+		override("file_mode", fileMode, cfg.Output.FileMode)
+		override("package_suffix", packageSuffix, cfg.Output.PackageSuffix)
+		override("source_import_path", sourceImportPath, cfg.Output.SourceImportPath)
+		override("cache", cachePath, cfg.resolve(cfg.Cache))
+		if !set["runtime"] && cfg.Output.Runtime {
+			*useRuntime = true
+		}
+
+		if len(args) == 0 && *file == "" {
+			for _, input := range cfg.Inputs {
+				args = append(args, cfg.resolve(input))
+			}
+		}
+	}
+
+	err := validateOutputPattern(*outputPattern)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var mode os.FileMode
+	if *fileMode != "" {
+		m, err := strconv.ParseUint(*fileMode, 8, 32)
+		if err != nil || m == 0 || m > 0777 {
+			log.Fatalf("invalid file mode '%s', expected octal permissions like 0644\n", *fileMode)
+		}
+		mode = os.FileMode(m)
+	}
+
+	templates, err := otelgen.LoadTemplates(*templatePath)
+	if err != nil {
+		log.Fatalf("failed to load templates\nerr: %v\n", err)
+	}
+	opts := options{
+		templates:        templates,
+		config:           cfg,
+		packageSuffix:    *packageSuffix,
+		sourceImportPath: *sourceImportPath,
+		outputPattern:    *outputPattern,
+		outputRoot:       *outputRoot,
+		fileMode:         mode,
+		check:            *check,
+		prune:            *prune,
+		atomic:           *atomic,
+		runtime:          *useRuntime,
+		jobs:             *jobs,
+		logger:           log.Default(),
+		stdout:           os.Stdout,
+		state:            &runState{outputs: make(map[string]bool), staged: make(map[string]string)},
+	}
+	if *reportPath != "" {
+		opts.state.report = &report{
+			Version:     otelgen.Version(),
+			Start:       start,
+			Sources:     []reportSource{},
+			Pruned:      []string{},
+			Diagnostics: []reportDiagnostic{},
+		}
+		opts.state.reportPath = *reportPath
+	}
+	if *cachePath != "" {
+		settings, err := generatorSettings(opts, *templatePath)
+		if err != nil {
+			log.Fatalf("failed to hash the settings of the generator\nerr: %v\n", err)
+		}
+		opts.cache, err = loadCache(*cachePath, settings)
+		if err != nil {
+			log.Fatalf("failed to load cache\nerr: %v\n", err)
+		}
+	}
+
+	if *file != "" {
+		if len(args) > 0 || *watchMode {
+			log.Fatal("-file can't be used with other paths or -watch")
+		}
+		err := processSingleFile(opts, *file, *output)
+		if err != nil {
+			opts.recordError(*file, err)
+			opts.commitStaged()
+			opts.finishReport()
+			log.Fatalf("failed to generate instrumentation for source '%s'\nerr: %v\n", *file, err)
+		}
+		opts.commitStaged()
+		opts.finishReport()
+		opts.saveCache()
+		if opts.state.isStale() {
+			log.Print("generated files are out of date, run connectrpc-otel-gen to update them")
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *watchMode && (opts.check || len(args) == 0) {
+		log.Fatal("-watch requires the paths of directories to watch and can't be used with -check")
+	}
+
+	if *txtar && len(args) > 0 {
+		log.Fatal("-txtar reads the sources from STDIN and can't be used with paths")
+	}
+	if len(args) == 0 {
+		if opts.check {
+			log.Fatal("-check requires the paths of the sources to check")
+		}
+		if *txtar {
+			if opts.packageSuffix != "" && opts.sourceImportPath == "" {
+				log.Fatal("-source_import_path is required to generate into a separate package from STDIN")
+			}
+			archive, err := processArchive(opts, os.Stdin)
+			if err != nil {
+				log.Fatal(err)
+			}
+			os.Stdout.Write(archive)
+			opts.finishReport()
+			if opts.state.hasFailed() {
+				os.Exit(1)
+			}
+			return
+		}
+		generated, services, err := processFile(opts, "STDIN", os.Stdin, true)
+		if err != nil {
+			opts.recordError("STDIN", err)
+			opts.recordSource("STDIN", "", statusFailed, services, start)
+			opts.finishReport()
+			log.Fatal(err)
+		}
 		fmt.Print(generated)
+		opts.recordSource("STDIN", "", statusWritten, services, start)
+		opts.finishReport()
 		return
 	}
 
-	for _, dir := range directories {
-		processFilesRecursively(dir)
+	var protoFiles, patterns []string
+	for _, arg := range args {
+		if strings.HasSuffix(arg, ".proto") {
+			protoFiles = append(protoFiles, arg)
+			continue
+		}
+		patterns = append(patterns, arg)
+	}
+	processDirs(opts, resolvePatterns(opts, patterns, *allDirs))
+	if len(protoFiles) > 0 {
+		processProtoFiles(opts, protoFiles, protoPaths, *protoOut)
+	}
+	// commitStaged forgets the failures so that -watch starts over
+	failed := opts.state.hasFailed()
+	committed := opts.commitStaged()
+	failed = failed || opts.state.hasFailed()
+	// the report covers the first generation of -watch
+	opts.finishReport()
+	opts.saveCache()
+	message := ""
+	if failed {
+		message = "generating failed for some of the sources, see the errors above"
+	}
+	if !committed {
+		message = "nothing was written as generating failed, see the errors above"
+	}
+	// with -watch the failing sources are generated again once they change
+	if message != "" && *watchMode {
+		log.Print(message)
+	} else if message != "" {
+		log.Fatal(message)
+	}
+
+	if *watchMode {
+		if len(protoFiles) > 0 {
+			log.Print(".proto files are not watched, only the directories given are")
+		}
+		watch(opts, patterns, *allDirs, *watchInterval)
+	}
+
+	if opts.state.isStale() {
+		log.Print("generated files are out of date, run connectrpc-otel-gen to update them")
+		os.Exit(1)
 	}
 }
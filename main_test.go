@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testOptions returns the options of a run which discards its output.
+func testOptions() options {
+	return options{
+		logger: log.New(io.Discard, "", 0),
+		stdout: io.Discard,
+		state:  &runState{outputs: make(map[string]bool), staged: make(map[string]string)},
+	}
+}
+
+func TestCheckOutput(t *testing.T) {
+	dir := t.TempDir()
+	generated := []byte("package example\n")
+	tests := []struct {
+		name     string
+		existing []byte
+		want     string
+	}{
+		{name: "identical", existing: generated, want: statusUnchanged},
+		{name: "missing final newline", existing: []byte("package example"), want: statusStale},
+		{name: "missing file", want: statusStale},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name+".go")
+			if test.existing != nil {
+				err := os.WriteFile(path, test.existing, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := testOptions()
+			got, err := opts.checkOutput(path, generated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got status %q, want %q", got, test.want)
+			}
+			if opts.state.isStale() != (test.want == statusStale) {
+				t.Errorf("got stale %t, want %t", opts.state.isStale(), test.want == statusStale)
+			}
+		})
+	}
+}
+
+func TestOutputName(t *testing.T) {
+	tests := []struct {
+		source  string
+		pattern string
+		want    string
+	}{
+		{source: "api.connect.go", want: "api.telemetry.go"},
+		{source: "api_grpc.pb.go", want: "api_grpc.telemetry.go"},
+		{source: "api.twirp.go", want: "api.twirp.telemetry.go"},
+		{source: "api_grpc.pb.go", pattern: "{name}_otel.go", want: "api_grpc_otel.go"},
+		{source: "api.pb.go"},
+	}
+	for _, test := range tests {
+		opts := options{outputPattern: test.pattern}
+		got, ok := opts.outputName(test.source)
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("got output %q, %t for %s, want %q", got, ok, test.source, test.want)
+		}
+	}
+}
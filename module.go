@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// findModule returns the directory of the go.mod enclosing dir and the path
+// of the module it declares.
+func findModule(dir string) (string, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	for {
+		f, err := os.Open(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				modulePath, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "module ")
+				if ok {
+					return dir, strings.Trim(strings.TrimSpace(modulePath), `"`), nil
+				}
+			}
+			return "", "", fmt.Errorf("'%s' does not declare a module path", filepath.Join(dir, "go.mod"))
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", fmt.Errorf("could not find a go.mod enclosing '%s'", dir)
+		}
+		dir = parent
+	}
+}
+
+// resolveImportPath returns the import path of the package in dir according
+// to the enclosing go.mod.
+func resolveImportPath(dir string) (string, error) {
+	moduleDir, modulePath, err := findModule(dir)
+	if err != nil {
+		return "", err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(moduleDir, dir)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(modulePath, filepath.ToSlash(rel)), nil
+}
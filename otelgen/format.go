@@ -0,0 +1,183 @@
+package otelgen
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// section is a part of the generated source produced by a template, it ends
+// at the given offset.
+type section struct {
+	template string
+	end      int
+}
+
+// sourceBuilder accumulates generated source while keeping track of the
+// template each part of it was produced by.
+type sourceBuilder struct {
+	strings.Builder
+	sections []section
+}
+
+func (b *sourceBuilder) writeTemplate(template string, text string) {
+	b.WriteString(text)
+	b.sections = append(b.sections, section{template: template, end: b.Len()})
+}
+
+// templatesAt returns the templates which may have produced the source at
+// the offset. Errors such as a missing closing brace are only noticed at the
+// start of the following section, so when the offset falls there the
+// template of the previous section is returned first.
+func (b *sourceBuilder) templatesAt(offset int) []string {
+	source := b.String()
+	start := 0
+	for i, s := range b.sections {
+		if offset < s.end {
+			if i > 0 && strings.TrimSpace(source[start:offset]) == "" {
+				return []string{b.sections[i-1].template, s.template}
+			}
+			return []string{s.template}
+		}
+		start = s.end
+	}
+	return []string{"unknown template"}
+}
+
+// replaceSection replaces the text produced by the named template.
+func (b *sourceBuilder) replaceSection(template string, text string) {
+	source := b.String()
+	start := 0
+	for i, s := range b.sections {
+		if s.template != template {
+			start = s.end
+			continue
+		}
+		shift := len(text) - (s.end - start)
+		b.Reset()
+		b.WriteString(source[:start] + text + source[s.end:])
+		for j := i; j < len(b.sections); j++ {
+			b.sections[j].end += shift
+		}
+		return
+	}
+}
+
+// blankLinesAfterBrace matches the blank lines following an opening brace.
+var blankLinesAfterBrace = regexp.MustCompile(`\{\n([ \t]*\n)+`)
+
+// format runs the generated source through gofmt, if it doesn't parse the
+// error points at the template which produced the offending code.
+func (b *sourceBuilder) format() ([]byte, error) {
+	// templates leaving parts of a function out can leave blank lines at the
+	// start of its body, which gofmt keeps
+	formatted, err := format.Source(blankLinesAfterBrace.ReplaceAll([]byte(b.String()), []byte("{\n")))
+	if err != nil {
+		// the offsets of the errors are those of the source as it was built
+		_, rawErr := format.Source([]byte(b.String()))
+		var list scanner.ErrorList
+		if errors.As(rawErr, &list) && len(list) > 0 {
+			return nil, fmt.Errorf(
+				"generated code near the output of %s does not parse\nerr: %w",
+				strings.Join(b.templatesAt(list[0].Pos.Offset), " or "),
+				rawErr,
+			)
+		}
+		return nil, err
+	}
+	return formatted, nil
+}
+
+// importGroup returns the group an import is placed in, the standard
+// library comes first, followed by imports of hosted modules and then the
+// remaining imports, which generally belong to the module being generated
+// for.
+func importGroup(path string) int {
+	// looking the package up with go/build would run the go command for
+	// anything outside of GOROOT
+	info, err := os.Stat(filepath.Join(build.Default.GOROOT, "src", filepath.FromSlash(path)))
+	if err == nil && info.IsDir() {
+		return 0
+	}
+	first, _, _ := strings.Cut(path, "/")
+	if strings.Contains(first, ".") {
+		return 1
+	}
+	return 2
+}
+
+// formatImports renders an import declaration with the imports grouped like
+// goimports does, gofmt takes care of sorting each group.
+// usedImports returns the imports the source refers to, those without an
+// alias are taken to be named after the last element of their path.
+func usedImports(src []byte, imports []importSpec) []importSpec {
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return imports
+	}
+	names := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				names[ident.Name] = true
+			}
+		}
+		return true
+	})
+
+	var used []importSpec
+	for _, imp := range imports {
+		name := imp.alias
+		if name == "" {
+			path := strings.Trim(imp.path, `"`)
+			name = path[strings.LastIndex(path, "/")+1:]
+		}
+		if names[name] {
+			used = append(used, imp)
+		}
+	}
+	return used
+}
+
+func formatImports(imports []importSpec) string {
+	groups := make([][]importSpec, 3)
+	for _, imp := range imports {
+		group := importGroup(strings.Trim(imp.path, `"`))
+		if slices.Contains(groups[group], imp) {
+			continue
+		}
+		groups[group] = append(groups[group], imp)
+	}
+
+	var builder strings.Builder
+	builder.WriteString("import (\n")
+	first := true
+	for _, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		if !first {
+			builder.WriteString("\n")
+		}
+		first = false
+		for _, imp := range group {
+			if imp.alias == "" {
+				builder.WriteString(fmt.Sprintf("\t%s\n", imp.path))
+				continue
+			}
+			builder.WriteString(fmt.Sprintf("\t%s %s\n", imp.alias, imp.path))
+		}
+	}
+	builder.WriteString(")")
+	return builder.String()
+}
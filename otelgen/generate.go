@@ -0,0 +1,332 @@
+package otelgen
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// outputFile describes the file the instrumentation is generated into.
+type outputFile struct {
+	pkgName string
+	// connectImportPath is the path the connect package is imported from if
+	// it is required.
+	connectImportPath string
+	// source is the name of the file the instrumentation is generated from,
+	// it is recorded in the header.
+	source string
+	// buildConstraint is the //go:build line of the source, if it has one.
+	buildConstraint string
+	// declareShared is Options.DeclareShared.
+	declareShared bool
+	// templates are the templates the wrappers are produced with, the
+	// defaults are used if it is nil.
+	templates *template.Template
+	// methodOptions returns the options of the methods, the defaults are
+	// used if it is nil.
+	methodOptions func(serviceFullName, serviceName, method string) MethodOptions
+	// runtime generates the wrappers with the "<kind>RuntimeMethod"
+	// templates, which call the runtime package.
+	runtime bool
+}
+
+// ErrNoServices is returned by Generate when every service is skipped and
+// the file doesn't have to declare what is shared either, so there is nothing
+// to generate.
+var ErrNoServices = errors.New("every service is skipped by the configuration")
+
+const headerTemplate = `// Code generated by connectrpc-otel-gen %s. DO NOT EDIT.
+`
+
+const headerSourceTemplate = `//
+// Source: %s
+`
+
+// modulePath is the path of the module the generator is published as.
+const modulePath = "github.com/LQR471814/connectrpc-otel-gen"
+
+// pseudoVersion matches the versions go stamps builds of untagged commits
+// with (ex. v0.0.0-20240101000000-abcdefabcdef).
+var pseudoVersion = regexp.MustCompile(`-(.+\.)?[0-9]{14}-[0-9a-f]{12}(\+dirty)?$`)
+
+// Version returns the version of the generator as recorded in the build
+// info, be it the main module or a dependency of the code generator
+// embedding it. Builds from a local checkout which isn't at a release tag
+// are "(devel)", rather than the pseudo-version go stamps them with, so that
+// the header of generated files doesn't change with every commit.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	module := &info.Main
+	if module.Path != modulePath {
+		module = nil
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				module = dep
+				if dep.Replace != nil {
+					module = dep.Replace
+				}
+				break
+			}
+		}
+	}
+	if module == nil || module.Version == "" {
+		return "(devel)"
+	}
+
+	localCheckout := false
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			localCheckout = true
+			break
+		}
+	}
+	if localCheckout && module == &info.Main && (pseudoVersion.MatchString(module.Version) || strings.HasSuffix(module.Version, "+dirty")) {
+		return "(devel)"
+	}
+	return module.Version
+}
+
+// generate returns the instrumentation for the targets.
+func generate(out outputFile, targets []*target) ([]byte, error) {
+	templates := out.templates
+	if templates == nil {
+		templates = template.Must(LoadTemplates(""))
+	}
+	data := newTemplateFile(out.pkgName, targets, out.methodOptions)
+	if len(data.Services) == 0 && !out.declareShared {
+		return nil, ErrNoServices
+	}
+
+	var builder sourceBuilder
+
+	builder.WriteString(fmt.Sprintf(headerTemplate, Version()))
+	if out.source != "" {
+		builder.WriteString(fmt.Sprintf(headerSourceTemplate, out.source))
+	}
+	builder.WriteString("\n")
+	if out.buildConstraint != "" {
+		builder.WriteString(out.buildConstraint + "\n\n")
+	}
+	builder.writeTemplate("headerTemplate", fmt.Sprintf("package %s\n\n", out.pkgName))
+
+	imports := []importSpec{
+		{path: `"context"`},
+	}
+	if len(data.Services) > 0 {
+		imports = append(imports, importSpec{path: `"go.opentelemetry.io/otel"`})
+	}
+	if hasMethodKind(
+		data,
+		KindEnvelope,
+		KindConnectServerStream,
+		KindConnectSimpleServerStream,
+		KindConnectStream,
+	) {
+		imports = append(imports, importSpec{alias: "connect", path: fmt.Sprintf("%q", out.connectImportPath)})
+	}
+	if out.runtime {
+		if slices.ContainsFunc(methods(data), instrumented) {
+			imports = append(imports, importSpec{path: fmt.Sprintf("%q", RuntimeImportPath)})
+		}
+		if recordsDuration(data) {
+			imports = append(imports, importSpec{path: `"go.opentelemetry.io/otel/metric"`})
+		}
+	} else {
+		if recordsErrors(data) {
+			imports = append(imports, importSpec{path: `"go.opentelemetry.io/otel/codes"`})
+		}
+		if capturesPayloads(data) || recordsDuration(data) {
+			imports = append(imports, importSpec{path: `"go.opentelemetry.io/otel/attribute"`})
+		}
+		if capturesPayloads(data) {
+			imports = append(imports, importSpec{path: `"google.golang.org/protobuf/encoding/protojson"`})
+		}
+		if redactsPayloads(data) {
+			imports = append(
+				imports,
+				importSpec{path: `"google.golang.org/protobuf/proto"`},
+				importSpec{path: `"google.golang.org/protobuf/reflect/protoreflect"`},
+			)
+		}
+		if recordsDuration(data) {
+			imports = append(
+				imports,
+				importSpec{path: `"time"`},
+				importSpec{path: `"go.opentelemetry.io/otel/metric"`},
+			)
+		}
+	}
+	if out.declareShared {
+		imports = append(imports, importSpec{path: `"go.opentelemetry.io/otel/trace"`})
+	}
+	for _, service := range data.Services {
+		imports = append(imports, service.imports...)
+	}
+	chosen := len(imports)
+	extraImports, err := executeTemplate(templates, "extraImports", data)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(extraImports, "\n") {
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 1:
+			imports = append(imports, importSpec{path: fields[0]})
+		case 2:
+			imports = append(imports, importSpec{alias: fields[0], path: fields[1]})
+		}
+	}
+	builder.writeTemplate("imports", formatImports(imports)+"\n\n")
+
+	write := func(name string, prefix string, data any) error {
+		text, err := executeTemplate(templates, name, data)
+		if err != nil {
+			return err
+		}
+		builder.writeTemplate(fmt.Sprintf("template %q", name), prefix+text+"\n\n")
+		return nil
+	}
+
+	if out.declareShared {
+		err = write("shared", "", data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data.Services) > 0 {
+		err = write("tracers", "", data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, service := range data.Services {
+		err = write("struct", "", service)
+		if err != nil {
+			return nil, err
+		}
+		err = write("constructor", "", service)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, method := range service.Methods {
+			if method.Traced && (method.Kind == KindServerStream.String() || method.Kind == KindServerStreamInput.String()) {
+				err = write("streamWrapper", "", method)
+				if err != nil {
+					return nil, err
+				}
+			}
+			name := method.Kind + "Method"
+			if out.runtime && instrumented(method) {
+				name = method.Kind + "RuntimeMethod"
+			}
+			err = write(name, method.Doc, method)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	formatted, err := builder.format()
+	if err != nil {
+		return nil, err
+	}
+	// the imports are chosen for the default templates, custom ones may not
+	// use all of them. Those of extraImports are kept as they are
+	used := usedImports(formatted, imports[:chosen])
+	if len(used) == chosen {
+		return formatted, nil
+	}
+	builder.replaceSection("imports", formatImports(append(used, imports[chosen:]...))+"\n\n")
+	return builder.format()
+}
+
+// executeTemplate executes the named template and returns its output.
+func executeTemplate(templates *template.Template, name string, data any) (string, error) {
+	var builder strings.Builder
+	err := templates.ExecuteTemplate(&builder, name, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute template %q\nerr: %w", name, err)
+	}
+	return builder.String(), nil
+}
+
+// methods returns the methods of the services of a file.
+func methods(data templateFile) []*templateMethod {
+	var methods []*templateMethod
+	for _, service := range data.Services {
+		methods = append(methods, service.Methods...)
+	}
+	return methods
+}
+
+// hasMethodKind reports whether any of the methods of the file has one of
+// the given kinds.
+func hasMethodKind(data templateFile, kinds ...MethodKind) bool {
+	for _, m := range methods(data) {
+		for _, kind := range kinds {
+			if m.Kind == kind.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// instrumented reports whether a method does more than forwarding calls to
+// the inner implementation.
+func instrumented(m *templateMethod) bool {
+	return m.Traced || m.Metrics
+}
+
+// capturesPayload reports whether a method records its input or output,
+// which bidirectional and client streams can't.
+func capturesPayload(m *templateMethod) bool {
+	if !m.Traced || !m.CapturePayloads {
+		return false
+	}
+	switch m.Kind {
+	case KindClientStream.String(), KindServerStream.String(), KindConnectStream.String():
+		return false
+	}
+	return true
+}
+
+// capturesPayloads reports whether any of the methods of the file can record
+// its input or output.
+func capturesPayloads(data templateFile) bool {
+	return slices.ContainsFunc(methods(data), capturesPayload)
+}
+
+// redactsPayloads reports whether any of the methods of the file clears
+// fields of the payloads it records.
+func redactsPayloads(data templateFile) bool {
+	return slices.ContainsFunc(methods(data), func(m *templateMethod) bool {
+		return capturesPayload(m) && len(m.Redact) > 0
+	})
+}
+
+// recordsErrors reports whether any of the traced methods of the file
+// returns an error, which connect's client and bidirectional streams don't
+// do when they are opened.
+func recordsErrors(data templateFile) bool {
+	return slices.ContainsFunc(methods(data), func(m *templateMethod) bool {
+		return m.Traced && m.Kind != KindConnectStream.String()
+	})
+}
+
+// recordsDuration reports whether any of the methods of the file records
+// the duration of calls.
+func recordsDuration(data templateFile) bool {
+	return slices.ContainsFunc(methods(data), func(m *templateMethod) bool {
+		return m.Metrics
+	})
+}
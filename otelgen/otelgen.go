@@ -0,0 +1,291 @@
+// Package otelgen generates opentelemetry instrumentation for the service
+// interfaces of connect, gRPC and twirp code, it is what connectrpc-otel-gen
+// is built on.
+//
+//	services, err := otelgen.Parse(src, otelgen.Options{Filename: "api.connect.go"})
+//	if err != nil {
+//		return err
+//	}
+//	generated, err := otelgen.Generate(services, otelgen.Options{Source: "api.connect.go", DeclareShared: true})
+package otelgen
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"text/template"
+)
+
+// ErrNoInterfaces is returned by Parse when the source doesn't declare any
+// service interface.
+var ErrNoInterfaces = errors.New("could not find connectrpc, grpc or twirp service interface")
+
+// DefaultConnectImportPath is the import path of connect-go used when a
+// service doesn't say otherwise.
+const DefaultConnectImportPath = "connectrpc.com/connect"
+
+// Framework is the code generator a service interface comes from.
+type Framework string
+
+const (
+	FrameworkConnect Framework = "connect"
+	FrameworkGRPC    Framework = "grpc"
+	FrameworkTwirp   Framework = "twirp"
+)
+
+// variablePrefix returns what the names of the variables generated for a
+// service of the framework are prefixed with after the name of the service,
+// so that services generated by different frameworks into the same package
+// don't collide. Connect keeps the plain names.
+func (f Framework) variablePrefix() string {
+	switch f {
+	case FrameworkGRPC:
+		return "GRPC"
+	case FrameworkTwirp:
+		return "Twirp"
+	}
+	return ""
+}
+
+// Service is an interface to instrument.
+type Service struct {
+	// Name is the name of the service (ex. AuthService).
+	Name string
+	// FullName is the proto name of the service (ex.
+	// services.auth.v1.AuthService).
+	FullName string
+	// Framework is the code generator of the interface, FrameworkConnect if
+	// it is empty. The variables generated for gRPC and twirp services are
+	// named after it (ex. AuthServiceGRPCTracer).
+	Framework Framework
+	// Interface is the name of the interface (ex. AuthServiceClient).
+	Interface string
+	// InterfacePackage is the name the package declaring the interface is
+	// imported as, it is empty when the instrumentation is generated into
+	// that package.
+	InterfacePackage string
+	// UnsafeInterface names the interface to embed to implement the
+	// unexported methods of Interface, if it has any (ex.
+	// UnsafeAuthServiceServer).
+	UnsafeInterface string
+	// Package is the name of the package declaring the interface.
+	Package string
+	// ConnectImportPath is the import path of the connect-go module the
+	// interface uses, DefaultConnectImportPath if it is empty.
+	ConnectImportPath string
+	// BuildConstraint is the //go:build line of the source, the generated
+	// file gets that of the first service.
+	BuildConstraint string
+	// Imports are the packages the types of the methods are qualified with.
+	Imports []Import
+	Methods []Method
+}
+
+// Method is a method of an interface to instrument.
+type Method struct {
+	Name       string
+	Kind       MethodKind
+	StreamKind StreamKind
+	// RequestType and ResponseType are the message types of the method as
+	// they are referred to in the generated file, they may be empty for
+	// streams generated by protoc-gen-go-grpc without generics.
+	RequestType  string
+	ResponseType string
+	// StreamType is the type of the stream of streaming methods.
+	StreamType string
+	// Doc is the comment documenting the method, including the slashes.
+	Doc string
+}
+
+// Import is an import spec, Path is quoted.
+type Import struct {
+	Alias string
+	Path  string
+}
+
+// MethodOptions are the options of the instrumentation of a method.
+type MethodOptions struct {
+	// Skip leaves the method uninstrumented, without a span or the duration
+	// of its calls even if Metrics is set. It is still wrapped so that the
+	// instrumented struct implements the interface. Services with every
+	// method skipped aren't generated.
+	Skip bool
+	// CapturePayloads controls whether the input and output can be recorded
+	// with WithInputOutput, the code doing so isn't generated if it is false.
+	CapturePayloads bool
+	// Redact are the names of fields cleared from recorded payloads.
+	Redact []string
+	// Metrics records the duration of calls in a histogram.
+	Metrics bool
+}
+
+// DefaultMethodOptions are the options of methods without any configuration.
+var DefaultMethodOptions = MethodOptions{CapturePayloads: true}
+
+// RuntimeImportPath is the import path of the package the wrappers
+// generated with Options.Runtime call.
+const RuntimeImportPath = "github.com/LQR471814/connectrpc-otel-gen/otelgen/runtime"
+
+// Options are the options of Parse and Generate, each of them only uses
+// some of the fields.
+type Options struct {
+	// Filename is the name of the source in the errors of Parse.
+	Filename string
+	// SourceImportPath is set when the instrumentation is generated into a
+	// different package than the source's, Parse qualifies the types
+	// declared in the source with its package name and imports it from this
+	// path.
+	SourceImportPath string
+
+	// Package is the name of the package Generate generates into, that of
+	// the first service by default.
+	Package string
+	// Source is the name of the file recorded in the header of the
+	// generated file, if it isn't empty.
+	Source string
+	// DeclareShared should only be true for one of the files generated into
+	// a package as it controls whether declarations shared by all generated
+	// files are included.
+	DeclareShared bool
+	// Templates are the templates the wrappers are generated with, see
+	// LoadTemplates. The defaults are used if it is nil.
+	Templates *template.Template
+	// MethodOptions returns the options of a method, DefaultMethodOptions
+	// are used if it is nil.
+	MethodOptions func(serviceFullName, serviceName, method string) MethodOptions
+	// Runtime generates wrappers which call the helpers of RuntimeImportPath
+	// instead of instrumenting the calls themselves.
+	Runtime bool
+}
+
+// Parse returns the service interfaces declared in a go source, it returns
+// ErrNoInterfaces if there are none.
+func Parse(src []byte, opts Options) ([]Service, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, opts.Filename, src, parser.SkipObjectResolution|parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	qualifier := ""
+	if opts.SourceImportPath != "" {
+		qualifier = file.Name.Name
+	}
+	targets, err := parseTargets(file, qualifier)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, ErrNoInterfaces
+	}
+
+	services := make([]Service, len(targets))
+	for i, t := range targets {
+		services[i] = t.export()
+		services[i].Package = file.Name.Name
+		services[i].ConnectImportPath, _ = parseConnectImport(file)
+		services[i].BuildConstraint = parseBuildConstraint(file)
+		if qualifier != "" {
+			services[i].Imports = append(services[i].Imports, Import{
+				Alias: qualifier,
+				Path:  fmt.Sprintf("%q", opts.SourceImportPath),
+			})
+		}
+	}
+	return services, nil
+}
+
+// Generate returns the instrumentation for the services, formatted with
+// gofmt. It returns ErrNoServices if every service is skipped and the file
+// doesn't declare what is shared either.
+func Generate(services []Service, opts Options) ([]byte, error) {
+	out := outputFile{
+		pkgName:           opts.Package,
+		connectImportPath: DefaultConnectImportPath,
+		source:            opts.Source,
+		declareShared:     opts.DeclareShared,
+		templates:         opts.Templates,
+		methodOptions:     opts.MethodOptions,
+		runtime:           opts.Runtime,
+	}
+	if len(services) > 0 {
+		if out.pkgName == "" {
+			out.pkgName = services[0].Package
+		}
+		if services[0].ConnectImportPath != "" {
+			out.connectImportPath = services[0].ConnectImportPath
+		}
+		out.buildConstraint = services[0].BuildConstraint
+	}
+	if out.pkgName == "" {
+		return nil, errors.New("the package to generate into is unknown, set it with Options.Package")
+	}
+
+	targets := make([]*target, len(services))
+	for i, service := range services {
+		targets[i] = newTarget(service)
+	}
+	return generate(out, targets)
+}
+
+// export converts a target to the Service it is exposed as.
+func (t *target) export() Service {
+	service := Service{
+		Name:             t.serviceName,
+		FullName:         t.fullServiceName,
+		Framework:        t.framework,
+		Interface:        t.intfName,
+		InterfacePackage: t.intfPackage,
+		UnsafeInterface:  t.unsafeIntfName,
+		Methods:          make([]Method, len(t.methods)),
+	}
+	for _, imp := range t.imports {
+		service.Imports = append(service.Imports, Import{Alias: imp.alias, Path: imp.path})
+	}
+	for i, m := range t.methods {
+		service.Methods[i] = Method{
+			Name:         m.name,
+			Kind:         m.kind,
+			StreamKind:   m.streamKind,
+			RequestType:  m.requestType,
+			ResponseType: m.responseType,
+			StreamType:   m.streamType,
+			Doc:          m.doc,
+		}
+	}
+	return service
+}
+
+// newTarget converts a Service back to the target it is generated from.
+func newTarget(service Service) *target {
+	t := &target{
+		serviceName:     service.Name,
+		intfName:        service.Interface,
+		intfPackage:     service.InterfacePackage,
+		unsafeIntfName:  service.UnsafeInterface,
+		fullServiceName: service.FullName,
+		framework:       service.Framework,
+	}
+	for _, imp := range service.Imports {
+		t.imports = append(t.imports, importSpec{alias: imp.Alias, path: imp.Path})
+	}
+	for _, m := range service.Methods {
+		t.methods = append(t.methods, targetMethod{
+			name:         m.Name,
+			kind:         m.Kind,
+			streamKind:   m.StreamKind,
+			requestType:  m.RequestType,
+			responseType: m.ResponseType,
+			streamType:   m.StreamType,
+			doc:          m.Doc,
+		})
+	}
+	return t
+}
+
+// QualifiedInterface returns the name of the interface qualified with the
+// package it is imported from, if it is.
+func (s Service) QualifiedInterface() string {
+	return qualify(s.InterfacePackage, s.Interface)
+}
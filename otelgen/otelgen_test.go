@@ -0,0 +1,411 @@
+package otelgen_test
+
+import (
+	"errors"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
+)
+
+const connectSource = `package authv1connect
+
+import (
+	connect "connectrpc.com/connect"
+	context "context"
+	v1 "example.com/gen/auth/v1"
+)
+
+const AuthServiceName = "services.auth.v1.AuthService"
+
+type AuthServiceClient interface {
+	// StartLogin starts a login.
+	StartLogin(context.Context, *connect.Request[v1.StartLoginRequest]) (*connect.Response[v1.StartLoginResponse], error)
+	Watch(context.Context, *connect.Request[v1.WatchRequest]) (*connect.ServerStreamForClient[v1.WatchResponse], error)
+	Chat(context.Context) *connect.BidiStreamForClient[v1.ChatRequest, v1.ChatResponse]
+}
+`
+
+const connectSimpleSource = `package authv1connect
+
+import (
+	connect "connectrpc.com/connect"
+	context "context"
+	v1 "example.com/gen/auth/v1"
+)
+
+const AuthServiceName = "services.auth.v1.AuthService"
+
+type AuthServiceClient interface {
+	StartLogin(context.Context, *v1.StartLoginRequest) (*v1.StartLoginResponse, error)
+	Watch(context.Context, *v1.WatchRequest) (*connect.ServerStreamForClient[v1.WatchResponse], error)
+}
+`
+
+const legacyConnectSource = `package authv1connect
+
+import (
+	context "context"
+	connect_go "github.com/bufbuild/connect-go"
+	v1 "example.com/gen/auth/v1"
+)
+
+const AuthServiceName = "services.auth.v1.AuthService"
+
+type AuthServiceClient interface {
+	StartLogin(context.Context, *connect_go.Request[v1.StartLoginRequest]) (*connect_go.Response[v1.StartLoginResponse], error)
+	Watch(context.Context, *connect_go.Request[v1.WatchRequest]) (*connect_go.ServerStreamForClient[v1.WatchResponse], error)
+}
+`
+
+const grpcSource = `package echov1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+)
+
+type EchoServiceClient interface {
+	Echo(ctx context.Context, in *EchoRequest, opts ...grpc.CallOption) (*EchoResponse, error)
+	Collect(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[EchoRequest, EchoResponse], error)
+	Expand(ctx context.Context, in *EchoRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[EchoResponse], error)
+}
+
+type EchoServiceServer interface {
+	Echo(context.Context, *EchoRequest) (*EchoResponse, error)
+	Expand(*EchoRequest, grpc.ServerStreamingServer[EchoResponse]) error
+	Chat(grpc.BidiStreamingServer[EchoRequest, EchoResponse]) error
+	mustEmbedUnimplementedEchoServiceServer()
+}
+
+type UnsafeEchoServiceServer interface {
+	mustEmbedUnimplementedEchoServiceServer()
+}
+
+var EchoService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "echo.v1.EchoService",
+}
+`
+
+const twirpSource = `package echov1
+
+import context "context"
+
+type EchoService interface {
+	Echo(context.Context, *EchoRequest) (*EchoResponse, error)
+}
+
+type TwirpServer interface {
+	ServeHTTP(w http.ResponseWriter, r *http.Request)
+}
+
+const EchoServicePathPrefix = "/twirp/echo.v1.EchoService/"
+`
+
+// method is what is expected of a parsed method.
+type method struct {
+	name   string
+	kind   otelgen.MethodKind
+	stream otelgen.StreamKind
+}
+
+func TestParseGenerate(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		opts      otelgen.Options
+		framework otelgen.Framework
+		fullName  string
+		// methods are those of the first service
+		methods []method
+		// contains are the lines expected in the generated code
+		contains []string
+		// excludes are the lines which mustn't be generated
+		excludes []string
+	}{
+		{
+			name:      "connect",
+			src:       connectSource,
+			framework: otelgen.FrameworkConnect,
+			fullName:  "services.auth.v1.AuthService",
+			methods: []method{
+				{"StartLogin", otelgen.KindEnvelope, otelgen.StreamUnary},
+				{"Watch", otelgen.KindConnectServerStream, otelgen.StreamServer},
+				{"Chat", otelgen.KindConnectStream, otelgen.StreamBidi},
+			},
+			contains: []string{
+				`connect "connectrpc.com/connect"`,
+				`AuthServiceTracer TracerLike = otel.Tracer("services.auth.v1.AuthService")`,
+				"// StartLogin starts a login.",
+				"func (c InstrumentedAuthServiceClient) StartLogin(ctx context.Context, req *connect.Request[v1.StartLoginRequest]) (*connect.Response[v1.StartLoginResponse], error) {",
+				"func (c InstrumentedAuthServiceClient) Watch(ctx context.Context, req *connect.Request[v1.WatchRequest]) (*connect.ServerStreamForClient[v1.WatchResponse], error) {",
+				"func (c InstrumentedAuthServiceClient) Chat(ctx context.Context) *connect.BidiStreamForClient[v1.ChatRequest, v1.ChatResponse] {",
+			},
+		},
+		{
+			name:      "connect simple",
+			src:       connectSimpleSource,
+			framework: otelgen.FrameworkConnect,
+			fullName:  "services.auth.v1.AuthService",
+			methods: []method{
+				{"StartLogin", otelgen.KindPlain, otelgen.StreamUnary},
+				{"Watch", otelgen.KindConnectSimpleServerStream, otelgen.StreamServer},
+			},
+			contains: []string{
+				"func (c InstrumentedAuthServiceClient) StartLogin(ctx context.Context, req *v1.StartLoginRequest) (*v1.StartLoginResponse, error) {",
+				"func (c InstrumentedAuthServiceClient) Watch(ctx context.Context, req *v1.WatchRequest) (*connect.ServerStreamForClient[v1.WatchResponse], error) {",
+			},
+		},
+		{
+			name:      "legacy connect",
+			src:       legacyConnectSource,
+			framework: otelgen.FrameworkConnect,
+			fullName:  "services.auth.v1.AuthService",
+			methods: []method{
+				{"StartLogin", otelgen.KindEnvelope, otelgen.StreamUnary},
+				{"Watch", otelgen.KindConnectServerStream, otelgen.StreamServer},
+			},
+			contains: []string{
+				`connect "github.com/bufbuild/connect-go"`,
+				"func (c InstrumentedAuthServiceClient) Watch(ctx context.Context, req *connect.Request[v1.WatchRequest]) (*connect.ServerStreamForClient[v1.WatchResponse], error) {",
+			},
+			excludes: []string{"connect_go"},
+		},
+		{
+			name:      "grpc",
+			src:       grpcSource,
+			framework: otelgen.FrameworkGRPC,
+			fullName:  "echo.v1.EchoService",
+			methods: []method{
+				{"Echo", otelgen.KindCallOptions, otelgen.StreamUnary},
+				{"Collect", otelgen.KindClientStream, otelgen.StreamClient},
+				{"Expand", otelgen.KindClientStreamInput, otelgen.StreamServer},
+			},
+			contains: []string{
+				`EchoServiceGRPCTracer TracerLike = otel.Tracer("echo.v1.EchoService")`,
+				"func (c InstrumentedEchoServiceClient) Echo(ctx context.Context, req *EchoRequest, opts ...grpc.CallOption) (*EchoResponse, error) {",
+				"func (c InstrumentedEchoServiceClient) Collect(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[EchoRequest, EchoResponse], error) {",
+				"func (c InstrumentedEchoServiceServer) Echo(ctx context.Context, req *EchoRequest) (*EchoResponse, error) {",
+				"func (c InstrumentedEchoServiceServer) Expand(req *EchoRequest, stream grpc.ServerStreamingServer[EchoResponse]) error {",
+				"func (c InstrumentedEchoServiceServer) Chat(stream grpc.BidiStreamingServer[EchoRequest, EchoResponse]) error {",
+				"UnsafeEchoServiceServer",
+			},
+		},
+		{
+			name:      "twirp",
+			src:       twirpSource,
+			framework: otelgen.FrameworkTwirp,
+			fullName:  "echo.v1.EchoService",
+			methods: []method{
+				{"Echo", otelgen.KindPlain, otelgen.StreamUnary},
+			},
+			contains: []string{
+				`EchoServiceTwirpTracer TracerLike = otel.Tracer("echo.v1.EchoService")`,
+				"func (c InstrumentedEchoService) Echo(ctx context.Context, req *EchoRequest) (*EchoResponse, error) {",
+			},
+			excludes: []string{"TwirpServer"},
+		},
+		{
+			name:      "separate package",
+			src:       grpcSource,
+			opts:      otelgen.Options{SourceImportPath: "example.com/gen/echo/v1", Package: "echov1otel"},
+			framework: otelgen.FrameworkGRPC,
+			fullName:  "echo.v1.EchoService",
+			methods: []method{
+				{"Echo", otelgen.KindCallOptions, otelgen.StreamUnary},
+				{"Collect", otelgen.KindClientStream, otelgen.StreamClient},
+				{"Expand", otelgen.KindClientStreamInput, otelgen.StreamServer},
+			},
+			contains: []string{
+				"package echov1otel",
+				`echov1 "example.com/gen/echo/v1"`,
+				"func NewInstrumentedEchoServiceClient(inner echov1.EchoServiceClient) InstrumentedEchoServiceClient {",
+				"func (c InstrumentedEchoServiceClient) Echo(ctx context.Context, req *echov1.EchoRequest, opts ...grpc.CallOption) (*echov1.EchoResponse, error) {",
+			},
+		},
+		{
+			name:      "runtime",
+			src:       connectSource,
+			opts:      otelgen.Options{Runtime: true},
+			framework: otelgen.FrameworkConnect,
+			fullName:  "services.auth.v1.AuthService",
+			methods: []method{
+				{"StartLogin", otelgen.KindEnvelope, otelgen.StreamUnary},
+				{"Watch", otelgen.KindConnectServerStream, otelgen.StreamServer},
+				{"Chat", otelgen.KindConnectStream, otelgen.StreamBidi},
+			},
+			contains: []string{
+				`"github.com/LQR471814/connectrpc-otel-gen/otelgen/runtime"`,
+				"	return runtime.Unary(ctx, runtime.Config{",
+				"	}, req, c.inner.StartLogin)",
+				"	}, req, c.inner.Watch)",
+			},
+			excludes: []string{"protojson", "go.opentelemetry.io/otel/codes"},
+		},
+		{
+			name: "skipped with metrics",
+			src:  connectSource,
+			opts: otelgen.Options{
+				MethodOptions: func(serviceFullName, serviceName, method string) otelgen.MethodOptions {
+					return otelgen.MethodOptions{Skip: method == "StartLogin", Metrics: true}
+				},
+			},
+			framework: otelgen.FrameworkConnect,
+			fullName:  "services.auth.v1.AuthService",
+			methods: []method{
+				{"StartLogin", otelgen.KindEnvelope, otelgen.StreamUnary},
+				{"Watch", otelgen.KindConnectServerStream, otelgen.StreamServer},
+				{"Chat", otelgen.KindConnectStream, otelgen.StreamBidi},
+			},
+			contains: []string{
+				`otel.Meter("services.auth.v1.AuthService").Float64Histogram(`,
+				`attribute.String("rpc.method", "Watch"),`,
+				"	res, err := c.inner.StartLogin(ctx, req)",
+			},
+			excludes: []string{`attribute.String("rpc.method", "StartLogin"),`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts
+			opts.Filename = "api.go"
+			services, err := otelgen.Parse([]byte(test.src), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(services) == 0 {
+				t.Fatal("no services parsed")
+			}
+			service := services[0]
+			if service.Framework != test.framework || service.FullName != test.fullName {
+				t.Errorf("got service %s of %s, want %s of %s", service.FullName, service.Framework, test.fullName, test.framework)
+			}
+			if len(service.Methods) != len(test.methods) {
+				t.Fatalf("got %d methods, want %d", len(service.Methods), len(test.methods))
+			}
+			for i, want := range test.methods {
+				got := service.Methods[i]
+				if got.Name != want.name || got.Kind != want.kind || got.StreamKind != want.stream {
+					t.Errorf("got method %s of kind %s (%s), want %s of kind %s (%s)", got.Name, got.Kind, got.StreamKind, want.name, want.kind, want.stream)
+				}
+			}
+
+			opts.DeclareShared = true
+			generated, err := otelgen.Generate(services, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Generate formats its output, so it must parse
+			_, err = parser.ParseFile(token.NewFileSet(), "api.telemetry.go", generated, parser.SkipObjectResolution)
+			if err != nil {
+				t.Fatalf("generated code does not parse\nerr: %v\n%s", err, generated)
+			}
+			for _, line := range test.contains {
+				if !strings.Contains(string(generated), line) {
+					t.Errorf("generated code doesn't contain %q\n%s", line, generated)
+				}
+			}
+			for _, text := range test.excludes {
+				if strings.Contains(string(generated), text) {
+					t.Errorf("generated code contains %q\n%s", text, generated)
+				}
+			}
+		})
+	}
+}
+
+func TestParseNoInterfaces(t *testing.T) {
+	_, err := otelgen.Parse([]byte("package example\n\ntype Message struct{}\n"), otelgen.Options{})
+	if !errors.Is(err, otelgen.ErrNoInterfaces) {
+		t.Errorf("got error %v, want %v", err, otelgen.ErrNoInterfaces)
+	}
+}
+
+func TestGenerateSkipped(t *testing.T) {
+	services, err := otelgen.Parse([]byte(connectSource), otelgen.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = otelgen.Generate(services, otelgen.Options{
+		MethodOptions: func(serviceFullName, serviceName, method string) otelgen.MethodOptions {
+			return otelgen.MethodOptions{Skip: true, Metrics: true}
+		},
+	})
+	if !errors.Is(err, otelgen.ErrNoServices) {
+		t.Errorf("got error %v, want %v", err, otelgen.ErrNoServices)
+	}
+}
+
+// readmeTemplate returns the template file of the custom templates example in
+// the README.
+func readmeTemplate(t *testing.T) string {
+	t.Helper()
+	readme, err := os.ReadFile("../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, section, _ := strings.Cut(string(readme), "### Custom templates")
+	_, example, _ := strings.Cut(section, "```go\n")
+	example, _, found := strings.Cut(example, "```")
+	if !found {
+		t.Fatal("the README has no custom templates example")
+	}
+	path := filepath.Join(t.TempDir(), "wrappers.tmpl")
+	err = os.WriteFile(path, []byte(example), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadmeTemplate(t *testing.T) {
+	const source = `package authv1
+
+import (
+	connect "connectrpc.com/connect"
+	context "context"
+)
+
+type StartLoginRequest struct{}
+
+type StartLoginResponse struct{}
+
+type AuthServiceClient interface {
+	StartLogin(context.Context, *connect.Request[StartLoginRequest]) (*connect.Response[StartLoginResponse], error)
+}
+`
+	templates, err := otelgen.LoadTemplates(readmeTemplate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := otelgen.Parse([]byte(source), otelgen.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := otelgen.Generate(services, otelgen.Options{Templates: templates, DeclareShared: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for name, src := range map[string]string{"auth.connect.go": source, "auth.telemetry.go": string(generated)} {
+		file, err := parser.ParseFile(fset, name, src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	_, err = conf.Check("authv1", fset, files, nil)
+	if err != nil {
+		t.Errorf("generated code does not type check\nerr: %v\n%s", err, generated)
+	}
+}
@@ -0,0 +1,624 @@
+package otelgen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build/constraint"
+	"go/token"
+	"go/types"
+	"slices"
+	"strings"
+)
+
+// connectImportPaths are the import paths connect-go has been published
+// under, the first one being the current path.
+var connectImportPaths = []string{
+	"connectrpc.com/connect",
+	"github.com/bufbuild/connect-go",
+}
+
+// MethodKind is the shape of an interface method's signature.
+type MethodKind int
+
+const (
+	// Method(ctx, *connect.Request[Req]) (*connect.Response[Res], error)
+	KindEnvelope MethodKind = iota
+	// Method(ctx, *Req) (*Res, error), used by connect-go's `simple` option
+	// and gRPC servers
+	KindPlain
+	// Method(ctx, *Req, ...grpc.CallOption) (*Res, error)
+	KindCallOptions
+	// Method(ctx, *Req, ...grpc.CallOption) (Stream, error)
+	KindClientStreamInput
+	// Method(ctx, ...grpc.CallOption) (Stream, error)
+	KindClientStream
+	// Method(*Req, Stream) error
+	KindServerStreamInput
+	// Method(Stream) error
+	KindServerStream
+	// Method(ctx, *connect.Request[Req]) (*connect.ServerStreamForClient[Res], error)
+	KindConnectServerStream
+	// Method(ctx, *Req) (*connect.ServerStreamForClient[Res], error)
+	KindConnectSimpleServerStream
+	// Method(ctx) *connect.ClientStreamForClient[Req, Res], the same goes for
+	// connect.BidiStreamForClient
+	KindConnectStream
+)
+
+var methodKindNames = [...]string{
+	KindEnvelope:                  "envelope",
+	KindPlain:                     "plain",
+	KindCallOptions:               "callOptions",
+	KindClientStreamInput:         "clientStreamInput",
+	KindClientStream:              "clientStream",
+	KindServerStreamInput:         "serverStreamInput",
+	KindServerStream:              "serverStream",
+	KindConnectServerStream:       "connectServerStream",
+	KindConnectSimpleServerStream: "connectSimpleServerStream",
+	KindConnectStream:             "connectStream",
+}
+
+// String returns the name of the kind as it is exposed to templates, the
+// template for a method is named after its kind with a "Method" suffix.
+func (k MethodKind) String() string {
+	return methodKindNames[k]
+}
+
+// StreamKind is the kind of streaming an rpc does, the values are exposed to
+// templates.
+type StreamKind string
+
+const (
+	StreamUnary  StreamKind = "unary"
+	StreamClient StreamKind = "client"
+	StreamServer StreamKind = "server"
+	StreamBidi   StreamKind = "bidi"
+)
+
+type targetMethod struct {
+	name         string
+	kind         MethodKind
+	requestType  string
+	responseType string
+	streamKind   StreamKind
+	// streamType is the type of the stream returned or accepted by
+	// streaming methods.
+	streamType string
+	// doc is the comment documenting the method, including the leading
+	// slashes.
+	doc string
+}
+
+type target struct {
+	serviceName string
+	intfName    string
+	// intfPackage is the name the package declaring the interface is
+	// imported as, it is empty when the instrumentation is generated into
+	// the same package.
+	intfPackage string
+	methods     []targetMethod
+
+	// unsafeIntfName is set when the interface has unexported methods (like
+	// gRPC's mustEmbedUnimplementedXxxServer), it names the interface that
+	// can be embedded to satisfy them.
+	unsafeIntfName string
+
+	fullServiceName string
+	framework       Framework
+
+	// imports are the packages the types of methods are qualified with, it
+	// is empty when the generated code lives in the same package as the
+	// messages.
+	imports []importSpec
+}
+
+type importSpec struct {
+	alias string
+	path  string
+}
+
+// fileParser holds the state shared by the interfaces parsed from a file.
+type fileParser struct {
+	// clientStreams are the names of the client stream interfaces declared
+	// in the file.
+	clientStreams map[string]bool
+	// qualifier is the name the types declared in the file are qualified
+	// with, it is set when the instrumentation is generated into another
+	// package.
+	qualifier string
+	// connectName is the name the file refers to the connect package by,
+	// the generated code always imports it as connect (legacy code imports
+	// it as connect_go).
+	connectName string
+}
+
+// typeString renders a type as it is referred to in the generated file.
+func (p fileParser) typeString(expr ast.Expr) string {
+	switch typedExpr := expr.(type) {
+	case *ast.Ident:
+		if p.qualifier != "" && typedExpr.IsExported() {
+			return p.qualifier + "." + typedExpr.Name
+		}
+		return typedExpr.Name
+	case *ast.SelectorExpr:
+		if ident, ok := typedExpr.X.(*ast.Ident); ok && ident.Name == p.connectName {
+			return "connect." + typedExpr.Sel.Name
+		}
+		return types.ExprString(expr)
+	case *ast.StarExpr:
+		return "*" + p.typeString(typedExpr.X)
+	case *ast.IndexExpr:
+		return fmt.Sprintf("%s[%s]", p.typeString(typedExpr.X), p.typeString(typedExpr.Index))
+	case *ast.IndexListExpr:
+		args := make([]string, len(typedExpr.Indices))
+		for i, index := range typedExpr.Indices {
+			args[i] = p.typeString(index)
+		}
+		return fmt.Sprintf("%s[%s]", p.typeString(typedExpr.X), strings.Join(args, ", "))
+	default:
+		return types.ExprString(expr)
+	}
+}
+
+func (p fileParser) parseMethod(field *ast.Field) (method targetMethod, err error) {
+	typedMethod := field.Type.(*ast.FuncType)
+	methodName := field.Names[0].Name
+
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf(
+				"failed to parse interface method %s, is the input file a connectrpc, grpc or twirp generation?\nerr: %v",
+				methodName,
+				r,
+			)
+		}
+	}()
+
+	params := typedMethod.Params.List
+	results := typedMethod.Results.List
+	_, variadic := params[len(params)-1].Type.(*ast.Ellipsis)
+
+	method = targetMethod{name: methodName, streamKind: StreamUnary}
+	if field.Doc != nil {
+		for _, comment := range field.Doc.List {
+			method.doc += comment.Text + "\n"
+		}
+	}
+
+	var stream ast.Expr
+	switch {
+	case len(results) == 1:
+		if _, ok := results[0].Type.(*ast.StarExpr); ok {
+			method.kind = KindConnectStream
+			stream = results[0].Type
+			break
+		}
+		stream = params[len(params)-1].Type
+		method.kind = KindServerStream
+		if len(params) == 2 {
+			method.kind = KindServerStreamInput
+			method.requestType = p.typeString(params[0].Type.(*ast.StarExpr).X)
+		}
+	case variadic && len(params) == 2:
+		method.kind = KindClientStream
+		stream = results[0].Type
+	case variadic:
+		method.requestType = p.typeString(params[1].Type.(*ast.StarExpr).X)
+		if res, ok := results[0].Type.(*ast.StarExpr); ok {
+			method.kind = KindCallOptions
+			method.responseType = p.typeString(res.X)
+			break
+		}
+		method.kind = KindClientStreamInput
+		stream = results[0].Type
+	case isConnectServerStream(results[0].Type):
+		req, reqSimple := parseMessageType(params[1].Type)
+		method.kind = KindConnectServerStream
+		if reqSimple {
+			method.kind = KindConnectSimpleServerStream
+		}
+		method.requestType = p.typeString(req)
+		stream = results[0].Type
+	default:
+		req, reqSimple := parseMessageType(params[1].Type)
+		res, resSimple := parseMessageType(results[0].Type)
+		if reqSimple != resSimple {
+			panic("request and response use different signature styles")
+		}
+		method.kind = KindEnvelope
+		if reqSimple {
+			method.kind = KindPlain
+		}
+		method.requestType = p.typeString(req)
+		method.responseType = p.typeString(res)
+	}
+
+	if stream == nil {
+		return method, nil
+	}
+	method.streamType = p.typeString(stream)
+
+	// generic streams carry their message types as type arguments, the
+	// streams protoc-gen-go-grpc generated before generics don't
+	args := p.streamTypeArgs(stream)
+	switch method.kind {
+	case KindClientStreamInput, KindServerStreamInput, KindConnectServerStream, KindConnectSimpleServerStream:
+		method.streamKind = StreamServer
+		if len(args) == 1 {
+			method.responseType = args[0]
+		}
+	default:
+		method.streamKind = StreamBidi
+		if isClientStream(types.ExprString(stream), p.clientStreams) {
+			method.streamKind = StreamClient
+		}
+		if len(args) == 2 {
+			method.requestType = args[0]
+			method.responseType = args[1]
+		}
+	}
+	return method, nil
+}
+
+// streamTypeArgs returns the type arguments of a generic stream type.
+func (p fileParser) streamTypeArgs(expr ast.Expr) []string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	switch typedExpr := expr.(type) {
+	case *ast.IndexExpr:
+		return []string{p.typeString(typedExpr.Index)}
+	case *ast.IndexListExpr:
+		args := make([]string, len(typedExpr.Indices))
+		for i, index := range typedExpr.Indices {
+			args[i] = p.typeString(index)
+		}
+		return args
+	}
+	return nil
+}
+
+// isClientStream tells client streams apart from bidirectional ones, which
+// share a signature.
+func isClientStream(streamType string, clientStreams map[string]bool) bool {
+	switch {
+	case strings.Contains(streamType, "ClientStream"):
+		return true
+	case strings.Contains(streamType, "Bidi"):
+		return false
+	}
+	return clientStreams[streamType]
+}
+
+// parseClientStreams returns the names of the client stream interfaces
+// protoc-gen-go-grpc declared before it used generics, they are the ones with
+// a CloseAndRecv or SendAndClose method.
+func parseClientStreams(file *ast.File) map[string]bool {
+	streams := make(map[string]bool)
+	for _, decl := range file.Decls {
+		typedDecl, ok := decl.(*ast.GenDecl)
+		if !ok || typedDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range typedDecl.Specs {
+			typedSpec := spec.(*ast.TypeSpec)
+			intf, ok := typedSpec.Type.(*ast.InterfaceType)
+			if !ok {
+				continue
+			}
+			for _, field := range intf.Methods.List {
+				if len(field.Names) == 0 {
+					continue
+				}
+				name := field.Names[0].Name
+				if name == "CloseAndRecv" || name == "SendAndClose" {
+					streams[typedSpec.Name.Name] = true
+				}
+			}
+		}
+	}
+	return streams
+}
+
+// parseMessageType extracts the message type out of either an enveloped
+// parameter (*connect.Request[v1.Msg]) or a simple one (*v1.Msg), the
+// returned boolean is true for the latter.
+func parseMessageType(expr ast.Expr) (ast.Expr, bool) {
+	switch typedExpr := expr.(*ast.StarExpr).X.(type) {
+	case *ast.IndexExpr:
+		return typedExpr.Index, false
+	default:
+		return typedExpr, true
+	}
+}
+
+// isConnectServerStream reports whether the type is a
+// *connect.ServerStreamForClient[Res].
+func isConnectServerStream(expr ast.Expr) bool {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	index, ok := star.X.(*ast.IndexExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := index.X.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "ServerStreamForClient"
+}
+
+// parseConnectImport returns the import path of the connect package used by
+// the file and the name it is referred to by, defaulting to the current path
+// if it isn't imported.
+func parseConnectImport(file *ast.File) (string, string) {
+	for _, imp := range file.Imports {
+		path := strings.Trim(imp.Path.Value, `"`)
+		if slices.Contains(connectImportPaths, path) {
+			return path, importName(imp)
+		}
+	}
+	return connectImportPaths[0], "connect"
+}
+
+// parseFramework returns the code generator of the file, from the twirp
+// services it declares or the packages it imports.
+func parseFramework(file *ast.File, twirpServices map[string]string) Framework {
+	if len(twirpServices) > 0 {
+		return FrameworkTwirp
+	}
+	for _, imp := range file.Imports {
+		if strings.Trim(imp.Path.Value, `"`) == "google.golang.org/grpc" {
+			return FrameworkGRPC
+		}
+	}
+	return FrameworkConnect
+}
+
+// parseBuildConstraint returns the //go:build line of the file, if it has
+// one.
+func parseBuildConstraint(file *ast.File) string {
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if constraint.IsGoBuild(comment.Text) {
+				return comment.Text
+			}
+		}
+	}
+	return ""
+}
+
+// importName returns the name an import is referred to by in the file.
+func importName(imp *ast.ImportSpec) string {
+	if imp.Name != nil {
+		return imp.Name.Name
+	}
+	path := strings.Trim(imp.Path.Value, `"`)
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// qualifiers returns the package names used to qualify the types in the
+// given interface in the order they first appear, omitting the packages the
+// generated code always imports itself, connectName being the name of the
+// connect package in the file.
+func qualifiers(intf *ast.InterfaceType, connectName string) []string {
+	var names []string
+	ast.Inspect(intf, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		ident, ok := sel.X.(*ast.Ident)
+		if !ok || ident.Name == "context" || ident.Name == connectName || slices.Contains(names, ident.Name) {
+			return true
+		}
+		names = append(names, ident.Name)
+		return true
+	})
+	return names
+}
+
+// isServiceInterface reports whether a type declared in the input is a
+// client or server interface that should be instrumented.
+func isServiceInterface(spec *ast.TypeSpec) bool {
+	if _, ok := spec.Type.(*ast.InterfaceType); !ok {
+		return false
+	}
+	name := spec.Name.String()
+	firstChar := name[0]
+	if firstChar < 'A' || firstChar > 'Z' {
+		return false
+	}
+	// protoc-gen-go-grpc declares Xxx_MethodClient stream interfaces and
+	// UnsafeXxxServer interfaces alongside the service interfaces
+	if strings.Contains(name, "_") || strings.HasPrefix(name, "Unsafe") {
+		return false
+	}
+	return strings.HasSuffix(name, "Client") || strings.HasSuffix(name, "Server")
+}
+
+// parseTwirpServices returns the full names of the services declared in a
+// twirp generated file keyed by the name of their interface, twirp names the
+// interface after the service and declares a XxxPathPrefix constant for it.
+func parseTwirpServices(file *ast.File) map[string]string {
+	services := make(map[string]string)
+	for _, decl := range file.Decls {
+		typedDecl, ok := decl.(*ast.GenDecl)
+		if !ok || typedDecl.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range typedDecl.Specs {
+			typedSpec := spec.(*ast.ValueSpec)
+			for i, ident := range typedSpec.Names {
+				name, ok := strings.CutSuffix(ident.Name, "PathPrefix")
+				if !ok || i >= len(typedSpec.Values) {
+					continue
+				}
+				value, ok := typedSpec.Values[i].(*ast.BasicLit)
+				if !ok || value.Kind != token.STRING {
+					continue
+				}
+				// "/twirp/pkg.Service/" -> "pkg.Service"
+				prefix := strings.Trim(value.Value[1:len(value.Value)-1], "/")
+				services[name] = prefix[strings.LastIndex(prefix, "/")+1:]
+			}
+		}
+	}
+	return services
+}
+
+func (p fileParser) parseInterface(spec *ast.TypeSpec, serviceName string) (*target, error) {
+	typedType := spec.Type.(*ast.InterfaceType)
+	name := spec.Name.String()
+
+	t := &target{
+		serviceName: serviceName,
+		intfName:    name,
+		intfPackage: p.qualifier,
+	}
+	for _, field := range typedType.Methods.List {
+		if !field.Names[0].IsExported() {
+			t.unsafeIntfName = "Unsafe" + name
+			continue
+		}
+		method, err := p.parseMethod(field)
+		if err != nil {
+			return nil, err
+		}
+		t.methods = append(t.methods, method)
+	}
+	return t, nil
+}
+
+// parseTargets returns the service interfaces of the file, qualifier is the
+// name of the file's package if the instrumentation is generated into
+// another package and empty otherwise.
+func parseTargets(file *ast.File, qualifier string) ([]*target, error) {
+	var targetList []*target
+
+	// twirp files declare other exported interfaces like HTTPClient and
+	// TwirpServer, so only the service interfaces are picked from them
+	twirpServices := parseTwirpServices(file)
+	p := fileParser{
+		clientStreams: parseClientStreams(file),
+		qualifier:     qualifier,
+	}
+	_, p.connectName = parseConnectImport(file)
+	framework := parseFramework(file, twirpServices)
+
+	for _, decl := range file.Decls {
+		switch typedDecl := decl.(type) {
+		case *ast.GenDecl:
+			if typedDecl.Tok != token.TYPE {
+				break
+			}
+			for _, spec := range typedDecl.Specs {
+				typedSpec := spec.(*ast.TypeSpec)
+				name := typedSpec.Name.String()
+
+				var t *target
+				var err error
+				switch {
+				case len(twirpServices) > 0:
+					fullServiceName, ok := twirpServices[name]
+					if !ok {
+						continue
+					}
+					t, err = p.parseInterface(typedSpec, name)
+					if t != nil {
+						t.fullServiceName = fullServiceName
+					}
+				case isServiceInterface(typedSpec):
+					t, err = p.parseInterface(typedSpec, name[:len(name)-6])
+				default:
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				for _, name := range qualifiers(typedSpec.Type.(*ast.InterfaceType), p.connectName) {
+					for _, imp := range file.Imports {
+						if importName(imp) == name {
+							t.imports = append(t.imports, importSpec{
+								alias: name,
+								path:  imp.Path.Value,
+							})
+							break
+						}
+					}
+				}
+				t.framework = framework
+				targetList = append(targetList, t)
+			}
+		}
+	}
+
+	for _, decl := range file.Decls {
+		switch typedDecl := decl.(type) {
+		case *ast.GenDecl:
+			switch typedDecl.Tok {
+			case token.CONST:
+				for _, spec := range typedDecl.Specs {
+					typedSpec := spec.(*ast.ValueSpec)
+
+					for i, ident := range typedSpec.Names {
+						for _, target := range targetList {
+							if ident.Name == target.serviceName+"Name" {
+								value := typedSpec.Values[i].(*ast.BasicLit)
+								// remove quotes from string
+								target.fullServiceName = value.Value[1 : len(value.Value)-1]
+								break
+							}
+						}
+					}
+				}
+			case token.VAR:
+				// protoc-gen-go-grpc has no service name constant, it
+				// is a field of the Xxx_ServiceDesc variable instead
+				for _, spec := range typedDecl.Specs {
+					typedSpec := spec.(*ast.ValueSpec)
+
+					for i, ident := range typedSpec.Names {
+						for _, target := range targetList {
+							// the client and server interfaces share the name
+							if ident.Name == target.serviceName+"_ServiceDesc" && i < len(typedSpec.Values) {
+								target.fullServiceName = parseServiceDescName(typedSpec.Values[i])
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return targetList, nil
+}
+
+// parseServiceDescName returns the ServiceName field of a grpc.ServiceDesc
+// composite literal.
+func parseServiceDescName(expr ast.Expr) string {
+	lit, ok := expr.(*ast.CompositeLit)
+	if !ok {
+		return ""
+	}
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		key, ok := kv.Key.(*ast.Ident)
+		if !ok || key.Name != "ServiceName" {
+			continue
+		}
+		value, ok := kv.Value.(*ast.BasicLit)
+		if !ok {
+			return ""
+		}
+		// remove quotes from string
+		return value.Value[1 : len(value.Value)-1]
+	}
+	return ""
+}
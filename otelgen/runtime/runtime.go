@@ -0,0 +1,196 @@
+// Package runtime implements the instrumentation of the code generated by
+// connectrpc-otel-gen with -runtime, the generated methods only describe
+// themselves with a Config and call the helper matching their signature.
+// Fixes to the instrumentation therefore don't require regenerating, and it
+// behaves the same for every service.
+package runtime
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Tracer starts the spans of calls, it is implemented by trace.Tracer and the
+// TracerLike interface of generated files.
+type Tracer interface {
+	Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span)
+}
+
+// Config describes the instrumentation of a call.
+type Config struct {
+	// Tracer starts the span of the call, no span is started if it is nil.
+	Tracer Tracer
+	// Duration is the histogram the duration of the call is recorded in, in
+	// milliseconds. It isn't recorded if it is nil.
+	Duration metric.Float64Histogram
+	// Service is the proto name of the service (ex.
+	// services.auth.v1.AuthService).
+	Service string
+	// Method is the name of the method (ex. StartLogin), it is the name of
+	// the span.
+	Method string
+	// CapturePayloads records the input and output of the call as the input
+	// and output attributes of the span in JSON.
+	CapturePayloads bool
+	// Redact are the names of the fields cleared from recorded payloads.
+	Redact []string
+}
+
+// call is the instrumentation of a call in progress.
+type call struct {
+	cfg   Config
+	ctx   context.Context
+	span  trace.Span
+	start time.Time
+}
+
+// begin starts the span and the timer of a call, the context it returns
+// carries the span.
+func begin(ctx context.Context, cfg Config) (*call, context.Context) {
+	c := &call{cfg: cfg, span: trace.SpanFromContext(context.Background())}
+	if cfg.Tracer != nil {
+		ctx, c.span = cfg.Tracer.Start(ctx, cfg.Method)
+	}
+	if cfg.Duration != nil {
+		c.start = time.Now()
+	}
+	c.ctx = ctx
+	return c, ctx
+}
+
+// end ends the span of the call and records its duration.
+func (c *call) end() {
+	if c.cfg.Duration != nil {
+		c.cfg.Duration.Record(c.ctx, float64(time.Since(c.start))/float64(time.Millisecond), metric.WithAttributes(
+			attribute.String("rpc.service", c.cfg.Service),
+			attribute.String("rpc.method", c.cfg.Method),
+		))
+	}
+	if c.cfg.Tracer != nil {
+		c.span.End()
+	}
+}
+
+// recordPayload records a payload as an attribute of the span if payloads are
+// captured, it can be a proto message or a connect request or response.
+func (c *call) recordPayload(key string, payload any) {
+	if !c.cfg.CapturePayloads || !c.span.IsRecording() {
+		return
+	}
+	if envelope, ok := payload.(interface{ Any() any }); ok {
+		payload = envelope.Any()
+	}
+	msg, ok := payload.(proto.Message)
+	if !ok {
+		return
+	}
+	if len(c.cfg.Redact) > 0 {
+		msg = redact(msg, c.cfg.Redact)
+	}
+
+	data, err := protojson.Marshal(msg)
+	if err != nil {
+		c.span.SetAttributes(attribute.String(key, "ERROR: FAILED TO SERIALIZE"))
+		c.span.RecordError(err)
+		return
+	}
+	c.span.SetAttributes(attribute.String(key, string(data)))
+}
+
+// recordError records the error of the call on the span, if there is one.
+func (c *call) recordError(err error) {
+	if err == nil || c.cfg.Tracer == nil {
+		return
+	}
+	c.span.RecordError(err)
+	c.span.SetStatus(codes.Error, err.Error())
+}
+
+// redact returns a copy of the message with the given fields cleared.
+func redact(msg proto.Message, fields []string) proto.Message {
+	msg = proto.Clone(msg)
+	if msg == nil || !msg.ProtoReflect().IsValid() {
+		return msg
+	}
+	descriptors := msg.ProtoReflect().Descriptor().Fields()
+	for _, name := range fields {
+		if field := descriptors.ByName(protoreflect.Name(name)); field != nil {
+			msg.ProtoReflect().Clear(field)
+		}
+	}
+	return msg
+}
+
+// Unary instruments a call taking a request and returning a response, which
+// are recorded if payloads are captured.
+func Unary[Req, Res any](ctx context.Context, cfg Config, req Req, fn func(context.Context, Req) (Res, error)) (Res, error) {
+	c, ctx := begin(ctx, cfg)
+	defer c.end()
+
+	c.recordPayload("input", req)
+	res, err := fn(ctx, req)
+	if err != nil {
+		c.recordError(err)
+		var zero Res
+		return zero, err
+	}
+	c.recordPayload("output", res)
+	return res, nil
+}
+
+// Stream instruments opening a stream with a request, the span only covers
+// opening the stream as it is returned to the caller.
+func Stream[Req, S any](ctx context.Context, cfg Config, req Req, open func(context.Context, Req) (S, error)) (S, error) {
+	c, ctx := begin(ctx, cfg)
+	defer c.end()
+
+	c.recordPayload("input", req)
+	stream, err := open(ctx, req)
+	if err != nil {
+		c.recordError(err)
+		var zero S
+		return zero, err
+	}
+	return stream, nil
+}
+
+// OpenStream instruments opening a stream without a request, see Stream.
+func OpenStream[S any](ctx context.Context, cfg Config, open func(context.Context) (S, error)) (S, error) {
+	c, ctx := begin(ctx, cfg)
+	defer c.end()
+
+	stream, err := open(ctx)
+	if err != nil {
+		c.recordError(err)
+		var zero S
+		return zero, err
+	}
+	return stream, nil
+}
+
+// Handle instruments the handler of a server stream, ctx is the context of
+// the stream and handle is called with the context of the span, which it
+// should pass on to the handler through the stream. The request is recorded
+// unless it is nil.
+func Handle(ctx context.Context, cfg Config, req any, handle func(context.Context) error) error {
+	c, ctx := begin(ctx, cfg)
+	defer c.end()
+
+	if req != nil {
+		c.recordPayload("input", req)
+	}
+	err := handle(ctx)
+	if err != nil {
+		c.recordError(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package runtime_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen/runtime"
+)
+
+// recordedSpan records what is set on it in memory.
+type recordedSpan struct {
+	tracenoop.Span
+	name       string
+	attributes map[attribute.Key]string
+	errors     []error
+	status     codes.Code
+	ended      bool
+}
+
+func (s *recordedSpan) IsRecording() bool { return true }
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attributes[attr.Key] = attr.Value.Emit()
+	}
+}
+
+func (s *recordedSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.errors = append(s.errors, err)
+}
+
+func (s *recordedSpan) SetStatus(code codes.Code, _ string) {
+	s.status = code
+}
+
+func (s *recordedSpan) End(...trace.SpanEndOption) {
+	s.ended = true
+}
+
+// recorder is a runtime.Tracer keeping the spans it starts.
+type recorder struct {
+	spans []*recordedSpan
+}
+
+func (r *recorder) Start(ctx context.Context, spanName string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordedSpan{name: spanName, attributes: make(map[attribute.Key]string)}
+	r.spans = append(r.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+// histogram records the attributes of the durations recorded in it.
+type histogram struct {
+	metricnoop.Float64Histogram
+	records []attribute.Set
+}
+
+func (h *histogram) Record(_ context.Context, _ float64, opts ...metric.RecordOption) {
+	h.records = append(h.records, metric.NewRecordConfig(opts).Attributes())
+}
+
+// envelope stands in for connect.Request and connect.Response.
+type envelope struct {
+	msg proto.Message
+}
+
+func (e envelope) Any() any {
+	return e.msg
+}
+
+func message() *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{Name: proto.String("password"), JsonName: proto.String("secret")}
+}
+
+// checkPayload checks that the attribute of the span holds the message, or
+// that it isn't set if the message is nil. protojson doesn't produce stable
+// output so the attribute is parsed back.
+func checkPayload(t *testing.T, span *recordedSpan, key attribute.Key, want *descriptorpb.FieldDescriptorProto) {
+	t.Helper()
+	data, ok := span.attributes[key]
+	if want == nil {
+		if ok {
+			t.Errorf("got %s %s, want none", key, data)
+		}
+		return
+	}
+	got := &descriptorpb.FieldDescriptorProto{}
+	err := protojson.Unmarshal([]byte(data), got)
+	if err != nil {
+		t.Fatalf("failed to parse %s %q\nerr: %v", key, data, err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("got %s %s, want %v", key, data, want)
+	}
+}
+
+func TestUnaryPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		capture bool
+		redact  []string
+		req     any
+		// want is the payload recorded as the input and output, nil if
+		// none is
+		want *descriptorpb.FieldDescriptorProto
+	}{
+		{
+			name:    "captured",
+			capture: true,
+			req:     message(),
+			want:    message(),
+		},
+		{
+			name:    "envelope",
+			capture: true,
+			req:     envelope{msg: message()},
+			want:    message(),
+		},
+		{
+			name:    "redacted",
+			capture: true,
+			redact:  []string{"json_name", "unknown"},
+			req:     message(),
+			want:    &descriptorpb.FieldDescriptorProto{Name: proto.String("password")},
+		},
+		{
+			name: "not captured",
+			req:  message(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracer := &recorder{}
+			cfg := runtime.Config{
+				Tracer:          tracer,
+				Service:         "test.v1.TestService",
+				Method:          "Call",
+				CapturePayloads: test.capture,
+				Redact:          test.redact,
+			}
+			res, err := runtime.Unary(context.Background(), cfg, test.req, func(ctx context.Context, req any) (any, error) {
+				if trace.SpanFromContext(ctx) != tracer.spans[0] {
+					t.Error("the call didn't get the context of the span")
+				}
+				return req, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != test.req {
+				t.Error("got a different response than the one returned")
+			}
+
+			span := tracer.spans[0]
+			if span.name != "Call" || !span.ended {
+				t.Errorf("got span %q ended %t, want an ended span named Call", span.name, span.ended)
+			}
+			checkPayload(t, span, "input", test.want)
+			checkPayload(t, span, "output", test.want)
+			// redacting works on a copy
+			if msg, ok := test.req.(*descriptorpb.FieldDescriptorProto); ok && msg.GetJsonName() != "secret" {
+				t.Error("redacting changed the request")
+			}
+		})
+	}
+}
+
+func TestUnaryError(t *testing.T) {
+	tracer := &recorder{}
+	hist := &histogram{}
+	cfg := runtime.Config{Tracer: tracer, Duration: hist, Service: "test.v1.TestService", Method: "Call"}
+	want := errors.New("failed")
+	res, err := runtime.Unary(context.Background(), cfg, message(), func(ctx context.Context, req *descriptorpb.FieldDescriptorProto) (*descriptorpb.FieldDescriptorProto, error) {
+		return req, want
+	})
+	if !errors.Is(err, want) || res != nil {
+		t.Errorf("got %v, %v, want nil, %v", res, err, want)
+	}
+	span := tracer.spans[0]
+	if span.status != codes.Error || len(span.errors) != 1 {
+		t.Errorf("got status %v with %d errors, want the error recorded", span.status, len(span.errors))
+	}
+
+	if len(hist.records) != 1 {
+		t.Fatalf("got %d durations, want 1", len(hist.records))
+	}
+	for key, want := range map[attribute.Key]string{"rpc.service": "test.v1.TestService", "rpc.method": "Call"} {
+		value, ok := hist.records[0].Value(key)
+		if !ok || value.AsString() != want {
+			t.Errorf("got %s %q, want %q", key, value.AsString(), want)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	tracer := &recorder{}
+	cfg := runtime.Config{Tracer: tracer, Method: "Stream", CapturePayloads: true, Redact: []string{"name"}}
+	err := runtime.Handle(context.Background(), cfg, message(), func(ctx context.Context) error {
+		if trace.SpanFromContext(ctx) != tracer.spans[0] {
+			t.Error("the handler didn't get the context of the span")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := tracer.spans[0]
+	checkPayload(t, span, "input", &descriptorpb.FieldDescriptorProto{JsonName: proto.String("secret")})
+	if !span.ended || len(span.errors) != 0 {
+		t.Errorf("got ended %t with %d errors, want an ended span without errors", span.ended, len(span.errors))
+	}
+
+	// streams without a request record nothing
+	tracer = &recorder{}
+	cfg.Tracer = tracer
+	err = runtime.Handle(context.Background(), cfg, nil, func(ctx context.Context) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.spans[0].attributes) != 0 {
+		t.Errorf("got attributes %v, want none", tracer.spans[0].attributes)
+	}
+}
+
+func TestNoTracer(t *testing.T) {
+	called := false
+	_, err := runtime.OpenStream(context.Background(), runtime.Config{Method: "Open"}, func(ctx context.Context) (int, error) {
+		called = true
+		if trace.SpanFromContext(ctx).SpanContext().IsValid() {
+			t.Error("a span was started without a tracer")
+		}
+		return 0, nil
+	})
+	if err != nil || !called {
+		t.Errorf("got called %t with error %v, want the stream opened", called, err)
+	}
+}
@@ -0,0 +1,555 @@
+package otelgen
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// The wrappers are produced by executing the following templates, a file
+// given to LoadTemplates (-template) is parsed on top of the defaults so any of
+// them can be redefined with {{define "name"}}.
+//
+//	"extraImports"   templateFile     additional import specs, one per line
+//	"shared"         templateFile     declarations shared by every generated
+//	                                  file of a package
+//	"tracers"        templateFile     the tracer variables
+//	"struct"         templateService  the instrumented struct
+//	"constructor"    templateService  the constructor of the instrumented struct
+//	"streamWrapper"  templateMethod   wraps server streams to carry the span
+//	                                  context, only for the serverStream and
+//	                                  serverStreamInput kinds
+//	"<kind>Method"   templateMethod   the wrapper of a method, named after the
+//	                                  kind of the method (ex. "envelopeMethod")
+//	"<kind>RuntimeMethod"
+//	                 templateMethod   the wrapper of a method calling the
+//	                                  otelgen/runtime package, with -runtime,
+//	                                  "<kind>Method" is used for methods which
+//	                                  are only forwarded
+//
+// the method templates are built from "startSpan" and "recordDuration", which
+// are executed with the templateMethod, and "recordInput", "recordOutput" and
+// "recordError", which are executed with a templateValue made with
+// {{record . "expression"}}.
+//
+// the method kinds are the following:
+//
+//	envelope                   Method(ctx, *connect.Request[Req]) (*connect.Response[Res], error)
+//	plain                      Method(ctx, *Req) (*Res, error)
+//	callOptions                Method(ctx, *Req, ...grpc.CallOption) (*Res, error)
+//	clientStreamInput          Method(ctx, *Req, ...grpc.CallOption) (Stream, error)
+//	clientStream               Method(ctx, ...grpc.CallOption) (Stream, error)
+//	serverStreamInput          Method(*Req, Stream) error
+//	serverStream               Method(Stream) error
+//	connectServerStream        Method(ctx, *connect.Request[Req]) (*connect.ServerStreamForClient[Res], error)
+//	connectSimpleServerStream  Method(ctx, *Req) (*connect.ServerStreamForClient[Res], error)
+//	connectStream              Method(ctx) *connect.ClientStreamForClient[Req, Res] or *connect.BidiStreamForClient[Req, Res]
+
+// templateFile is the data model of a generated file.
+type templateFile struct {
+	// Package is the name of the package the file is generated into.
+	Package  string
+	Services []*templateService
+	// Tracers are the tracer variables of the file, services sharing a name
+	// (like the client and server of a gRPC service) share a tracer.
+	Tracers []templateTracer
+}
+
+type templateTracer struct {
+	// Name is the name of the tracer variable (ex. AuthServiceTracer).
+	Name string
+	// ServiceFullName is the proto name of the service.
+	ServiceFullName string
+	// Duration is the name of the histogram variable the duration of calls
+	// is recorded in, it is empty if none of the methods record it.
+	Duration string
+}
+
+// templateService is the data model of an instrumented interface.
+type templateService struct {
+	// Name is the name of the service (ex. AuthService).
+	Name string
+	// FullName is the proto name of the service (ex.
+	// services.auth.v1.AuthService).
+	FullName string
+	// Interface is the name of the instrumented interface (ex.
+	// AuthServiceClient), it is qualified with the package declaring it when
+	// generating into a separate package (ex. authv1connect.AuthServiceClient).
+	Interface string
+	// UnsafeInterface names the interface to embed to implement the
+	// unexported methods of Interface, if it has any (ex.
+	// UnsafeAuthServiceServer).
+	UnsafeInterface string
+	// Instrumented is the name of the instrumented struct (ex.
+	// InstrumentedAuthServiceClient).
+	Instrumented string
+	// Tracer is the name of the tracer variable of the service.
+	Tracer string
+	// Duration is the name of the histogram variable of the service, see
+	// templateTracer.
+	Duration string
+	Methods  []*templateMethod
+
+	// imports are those required by the service's types.
+	imports []importSpec
+}
+
+// templateMethod is the data model of an instrumented method.
+type templateMethod struct {
+	Service *templateService
+	// Name is the name of the method (ex. StartLogin).
+	Name string
+	// FullName is the proto name of the method (ex.
+	// services.auth.v1.AuthService.StartLogin).
+	FullName string
+	// Procedure is the path of the method (ex.
+	// /services.auth.v1.AuthService/StartLogin).
+	Procedure string
+	// Kind is the shape of the signature of the method, see above.
+	Kind string
+	// StreamKind is one of "unary", "client", "server" or "bidi".
+	StreamKind string
+	// RequestType and ResponseType are those of Method.
+	RequestType  string
+	ResponseType string
+	// StreamType is the type of the stream of streaming methods.
+	StreamType string
+	// StreamWrapper is the name of the type wrapping server streams and
+	// StreamField the name of the stream field embedded in it.
+	StreamWrapper string
+	StreamField   string
+	// Doc is the comment documenting the method, including the slashes.
+	Doc string
+	// Traced is false for methods which are only forwarded to the inner
+	// interface.
+	Traced bool
+	// CapturePayloads is whether the input and output can be recorded.
+	CapturePayloads bool
+	// Redact are the names of the fields cleared from recorded payloads.
+	Redact []string
+	// Metrics is whether the duration of calls is recorded.
+	Metrics bool
+	// Context is the expression of the context of the call.
+	Context string
+}
+
+// templateValue is an expression of a method's wrapper along with the
+// method, it prints as the expression.
+type templateValue struct {
+	Method *templateMethod
+	Expr   string
+}
+
+func (v templateValue) String() string {
+	return v.Expr
+}
+
+// templateFuncs are the functions available to the templates.
+var templateFuncs = template.FuncMap{
+	"record": func(method *templateMethod, expr string) templateValue {
+		return templateValue{Method: method, Expr: expr}
+	},
+}
+
+// newTemplateFile builds the data model for the targets with the options
+// returned by methodOptions, which may be nil. Services whose methods are all
+// skipped are left out.
+func newTemplateFile(pkgName string, targets []*target, methodOptions func(serviceFullName, serviceName, method string) MethodOptions) templateFile {
+	file := templateFile{Package: pkgName}
+	for _, t := range targets {
+		service := &templateService{
+			Name:         t.serviceName,
+			FullName:     t.fullServiceName,
+			Interface:    qualify(t.intfPackage, t.intfName),
+			Instrumented: fmt.Sprintf("Instrumented%s", t.intfName),
+			Tracer:       fmt.Sprintf("%s%sTracer", t.serviceName, t.framework.variablePrefix()),
+			imports:      t.imports,
+		}
+		if t.unsafeIntfName != "" {
+			service.UnsafeInterface = qualify(t.intfPackage, t.unsafeIntfName)
+		}
+
+		traced := false
+		for _, m := range t.methods {
+			opts := DefaultMethodOptions
+			if methodOptions != nil {
+				opts = methodOptions(t.fullServiceName, t.serviceName, m.name)
+			}
+			// skipped methods are forwarded without a span or metrics
+			metrics := opts.Metrics && !opts.Skip
+			traced = traced || !opts.Skip
+			if metrics {
+				service.Duration = fmt.Sprintf("%s%sDuration", t.serviceName, t.framework.variablePrefix())
+			}
+			context := "ctx"
+			if m.kind == KindServerStream || m.kind == KindServerStreamInput {
+				context = "stream.Context()"
+			}
+			service.Methods = append(service.Methods, &templateMethod{
+				Service:      service,
+				Name:         m.name,
+				FullName:     fmt.Sprintf("%s.%s", t.fullServiceName, m.name),
+				Procedure:    fmt.Sprintf("/%s/%s", t.fullServiceName, m.name),
+				Kind:         m.kind.String(),
+				StreamKind:   string(m.streamKind),
+				RequestType:  m.requestType,
+				ResponseType: m.responseType,
+				StreamType:   m.streamType,
+				StreamWrapper: fmt.Sprintf(
+					"%s%sStream",
+					strings.ToLower(service.Instrumented[:1])+service.Instrumented[1:],
+					m.name,
+				),
+				StreamField:     embeddedFieldName(m.streamType),
+				Doc:             m.doc,
+				Traced:          !opts.Skip,
+				CapturePayloads: opts.CapturePayloads,
+				Redact:          opts.Redact,
+				Metrics:         metrics,
+				Context:         context,
+			})
+		}
+		if !traced {
+			continue
+		}
+
+		// the client and server interfaces of a gRPC service share a tracer
+		shared := false
+		for i, tracer := range file.Tracers {
+			if tracer.Name == service.Tracer {
+				shared = true
+				if service.Duration != "" {
+					file.Tracers[i].Duration = service.Duration
+				}
+				break
+			}
+		}
+		if !shared {
+			file.Tracers = append(file.Tracers, templateTracer{
+				Name:            service.Tracer,
+				ServiceFullName: service.FullName,
+				Duration:        service.Duration,
+			})
+		}
+		file.Services = append(file.Services, service)
+	}
+	return file
+}
+
+// qualify returns the name qualified with the package if it isn't empty.
+func qualify(pkg string, name string) string {
+	if pkg == "" {
+		return name
+	}
+	return pkg + "." + name
+}
+
+// embeddedFieldName returns the name of the field a type gets when it is
+// embedded in a struct, `ServerStreamingServer` for
+// `grpc.ServerStreamingServer[v1.Msg]`.
+func embeddedFieldName(typeName string) string {
+	typeName, _, _ = strings.Cut(typeName, "[")
+	return typeName[strings.LastIndex(typeName, ".")+1:]
+}
+
+// LoadTemplates returns the default templates, redefined by the templates in
+// the file at path if it isn't empty.
+func LoadTemplates(path string) (*template.Template, error) {
+	templates := template.Must(template.New("defaults").Funcs(templateFuncs).Parse(defaultTemplates))
+	if path == "" {
+		return templates, nil
+	}
+	return templates.ParseFiles(path)
+}
+
+const defaultTemplates = `
+{{- define "extraImports"}}{{end}}
+
+{{- define "shared"}}type TracerLike interface {
+	Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span)
+}{{end}}
+
+{{- define "tracers"}}var (
+{{- range .Tracers}}
+	{{.Name}} TracerLike = otel.Tracer("{{.ServiceFullName}}")
+{{- if .Duration}}
+	{{.Duration}}, _ = otel.Meter("{{.ServiceFullName}}").Float64Histogram(
+		"rpc.duration",
+		metric.WithUnit("ms"),
+		metric.WithDescription("Duration of calls to {{.ServiceFullName}}."),
+	)
+{{- end}}
+{{- end}}
+){{end}}
+
+{{- define "struct"}}type {{.Instrumented}} struct {
+{{- if .UnsafeInterface}}
+	{{.UnsafeInterface}}
+{{- end}}
+	inner {{.Interface}}
+	WithInputOutput bool
+}{{end}}
+
+{{- define "constructor"}}func New{{.Instrumented}}(inner {{.Interface}}) {{.Instrumented}} {
+	return {{.Instrumented}}{inner: inner}
+}{{end}}
+
+{{- /* redacted payloads are copied to clear the fields in, the copy is named
+msg */}}
+
+{{- define "redactPayload"}}
+{{- if .Method.Redact}}
+		msg := proto.Clone({{.}})
+		if msg != nil && msg.ProtoReflect().IsValid() {
+			fields := msg.ProtoReflect().Descriptor().Fields()
+			for _, name := range []protoreflect.Name{ {{- range $i, $field := .Method.Redact}}{{if $i}}, {{end}}"{{$field}}"{{end}}} {
+				if field := fields.ByName(name); field != nil {
+					msg.ProtoReflect().Clear(field)
+				}
+			}
+		}
+{{- end}}{{end}}
+
+{{- define "payload"}}{{if .Method.Redact}}msg{{else}}{{.}}{{end}}{{end}}
+
+{{- define "recordInput"}}{{if and .Method.Traced .Method.CapturePayloads}}	if span.IsRecording() && c.WithInputOutput {
+{{- template "redactPayload" .}}
+		input, err := protojson.Marshal({{template "payload" .}})
+		if err == nil {
+			span.SetAttributes(attribute.String("input", string(input)))
+		} else {
+			span.SetAttributes(attribute.String("input", "ERROR: FAILED TO SERIALIZE"))
+			span.RecordError(err)
+		}
+	}{{end}}{{end}}
+
+{{- define "recordOutput"}}{{if and .Method.Traced .Method.CapturePayloads}}	if span.IsRecording() && c.WithInputOutput {
+{{- template "redactPayload" .}}
+		output, err := protojson.Marshal({{template "payload" .}})
+		if err == nil {
+			span.SetAttributes(attribute.String("output", string(output)))
+		} else {
+			span.SetAttributes(attribute.String("output", "ERROR: FAILED TO SERIALIZE"))
+			span.RecordError(err)
+		}
+	}{{end}}{{end}}
+
+{{- define "recordError"}}	if err != nil {
+{{- if .Method.Traced}}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+{{- end}}
+		return {{.}}
+	}{{end}}
+
+{{- define "startSpan"}}{{if .Traced}}	ctx, span := {{.Service.Tracer}}.Start({{.Context}}, "{{.Name}}")
+	defer span.End(){{end}}{{template "recordDuration" .}}{{end}}
+
+{{- /* the duration is recorded with the context of the span if there is one */}}
+
+{{- define "recordDuration"}}{{if .Metrics}}
+	start := time.Now()
+	defer func() {
+		{{.Service.Duration}}.Record({{if .Traced}}ctx{{else}}{{.Context}}{{end}}, float64(time.Since(start))/float64(time.Millisecond), metric.WithAttributes(
+			attribute.String("rpc.service", "{{.Service.FullName}}"),
+			attribute.String("rpc.method", "{{.Name}}"),
+		))
+	}(){{end}}{{end}}
+
+{{- define "envelopeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *connect.Request[{{.RequestType}}]) (*connect.Response[{{.ResponseType}}], error) {
+{{template "startSpan" .}}
+
+{{template "recordInput" (record . "req.Msg")}}
+
+	res, err := c.inner.{{.Name}}(ctx, req)
+{{template "recordError" (record . "nil, err")}}
+
+{{template "recordOutput" (record . "res.Msg")}}
+
+	return res, nil
+}{{end}}
+
+{{- define "plainMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *{{.RequestType}}) (*{{.ResponseType}}, error) {
+{{template "startSpan" .}}
+
+{{template "recordInput" (record . "req")}}
+
+	res, err := c.inner.{{.Name}}(ctx, req)
+{{template "recordError" (record . "nil, err")}}
+
+{{template "recordOutput" (record . "res")}}
+
+	return res, nil
+}{{end}}
+
+{{- define "callOptionsMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *{{.RequestType}}, opts ...grpc.CallOption) (*{{.ResponseType}}, error) {
+{{template "startSpan" .}}
+
+{{template "recordInput" (record . "req")}}
+
+	res, err := c.inner.{{.Name}}(ctx, req, opts...)
+{{template "recordError" (record . "nil, err")}}
+
+{{template "recordOutput" (record . "res")}}
+
+	return res, nil
+}{{end}}
+
+{{- /* client streams are returned to the caller once they are opened, so
+the span only covers opening the stream */}}
+
+{{- define "clientStreamInputMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *{{.RequestType}}, opts ...grpc.CallOption) ({{.StreamType}}, error) {
+{{template "startSpan" .}}
+
+{{template "recordInput" (record . "req")}}
+
+	stream, err := c.inner.{{.Name}}(ctx, req, opts...)
+{{template "recordError" (record . "nil, err")}}
+
+	return stream, nil
+}{{end}}
+
+{{- define "clientStreamMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, opts ...grpc.CallOption) ({{.StreamType}}, error) {
+{{template "startSpan" .}}
+
+	stream, err := c.inner.{{.Name}}(ctx, opts...)
+{{template "recordError" (record . "nil, err")}}
+
+	return stream, nil
+}{{end}}
+
+{{- /* server streams carry the context of the call, so they are wrapped to
+pass the context of the span on to the handler */}}
+
+{{- define "streamWrapper"}}type {{.StreamWrapper}} struct {
+	{{.StreamType}}
+	ctx context.Context
+}
+
+func (s {{.StreamWrapper}}) Context() context.Context {
+	return s.ctx
+}{{end}}
+
+{{- define "serverStream"}}{{if .Traced}}{{.StreamWrapper}}{ {{- .StreamField}}: stream, ctx: ctx}{{else}}stream{{end}}{{end}}
+
+{{- define "serverStreamInputMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(req *{{.RequestType}}, stream {{.StreamType}}) error {
+{{template "startSpan" .}}
+
+{{template "recordInput" (record . "req")}}
+
+	err := c.inner.{{.Name}}(req, {{template "serverStream" .}})
+{{template "recordError" (record . "err")}}
+
+	return nil
+}{{end}}
+
+{{- define "serverStreamMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(stream {{.StreamType}}) error {
+{{template "startSpan" .}}
+
+	err := c.inner.{{.Name}}({{template "serverStream" .}})
+{{template "recordError" (record . "err")}}
+
+	return nil
+}{{end}}
+
+{{- define "connectServerStreamMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *connect.Request[{{.RequestType}}]) ({{.StreamType}}, error) {
+{{template "startSpan" .}}
+
+{{template "recordInput" (record . "req.Msg")}}
+
+	stream, err := c.inner.{{.Name}}(ctx, req)
+{{template "recordError" (record . "nil, err")}}
+
+	return stream, nil
+}{{end}}
+
+{{- define "connectSimpleServerStreamMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *{{.RequestType}}) ({{.StreamType}}, error) {
+{{template "startSpan" .}}
+
+{{template "recordInput" (record . "req")}}
+
+	stream, err := c.inner.{{.Name}}(ctx, req)
+{{template "recordError" (record . "nil, err")}}
+
+	return stream, nil
+}{{end}}
+
+{{- define "connectStreamMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context) {{.StreamType}} {
+{{template "startSpan" .}}
+
+	return c.inner.{{.Name}}(ctx)
+}{{end}}
+
+{{- /* with -runtime the methods call the helpers of the otelgen/runtime
+package, their templates are named "<kind>RuntimeMethod" */}}
+
+{{- define "runtimeConfig"}}runtime.Config{
+{{- if .Traced}}
+		Tracer: {{.Service.Tracer}},
+{{- end}}
+{{- if .Metrics}}
+		Duration: {{.Service.Duration}},
+{{- end}}
+		Service: "{{.Service.FullName}}",
+		Method: "{{.Name}}",
+{{- if and .Traced .CapturePayloads}}
+		CapturePayloads: c.WithInputOutput,
+{{- if .Redact}}
+		Redact: []string{ {{- range $i, $field := .Redact}}{{if $i}}, {{end}}"{{$field}}"{{end}}},
+{{- end}}
+{{- end}}
+	}{{end}}
+
+{{- define "envelopeRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *connect.Request[{{.RequestType}}]) (*connect.Response[{{.ResponseType}}], error) {
+	return runtime.Unary(ctx, {{template "runtimeConfig" .}}, req, c.inner.{{.Name}})
+}{{end}}
+
+{{- define "plainRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *{{.RequestType}}) (*{{.ResponseType}}, error) {
+	return runtime.Unary(ctx, {{template "runtimeConfig" .}}, req, c.inner.{{.Name}})
+}{{end}}
+
+{{- define "callOptionsRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *{{.RequestType}}, opts ...grpc.CallOption) (*{{.ResponseType}}, error) {
+	return runtime.Unary(ctx, {{template "runtimeConfig" .}}, req, func(ctx context.Context, req *{{.RequestType}}) (*{{.ResponseType}}, error) {
+		return c.inner.{{.Name}}(ctx, req, opts...)
+	})
+}{{end}}
+
+{{- define "clientStreamInputRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *{{.RequestType}}, opts ...grpc.CallOption) ({{.StreamType}}, error) {
+	return runtime.Stream(ctx, {{template "runtimeConfig" .}}, req, func(ctx context.Context, req *{{.RequestType}}) ({{.StreamType}}, error) {
+		return c.inner.{{.Name}}(ctx, req, opts...)
+	})
+}{{end}}
+
+{{- define "clientStreamRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, opts ...grpc.CallOption) ({{.StreamType}}, error) {
+	return runtime.OpenStream(ctx, {{template "runtimeConfig" .}}, func(ctx context.Context) ({{.StreamType}}, error) {
+		return c.inner.{{.Name}}(ctx, opts...)
+	})
+}{{end}}
+
+{{- define "serverStreamInputRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(req *{{.RequestType}}, stream {{.StreamType}}) error {
+	return runtime.Handle(stream.Context(), {{template "runtimeConfig" .}}, req, func(ctx context.Context) error {
+		return c.inner.{{.Name}}(req, {{template "serverStream" .}})
+	})
+}{{end}}
+
+{{- define "serverStreamRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(stream {{.StreamType}}) error {
+	return runtime.Handle(stream.Context(), {{template "runtimeConfig" .}}, nil, func(ctx context.Context) error {
+		return c.inner.{{.Name}}({{template "serverStream" .}})
+	})
+}{{end}}
+
+{{- define "connectServerStreamRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *connect.Request[{{.RequestType}}]) ({{.StreamType}}, error) {
+	return runtime.Stream(ctx, {{template "runtimeConfig" .}}, req, c.inner.{{.Name}})
+}{{end}}
+
+{{- define "connectSimpleServerStreamRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context, req *{{.RequestType}}) ({{.StreamType}}, error) {
+	return runtime.Stream(ctx, {{template "runtimeConfig" .}}, req, c.inner.{{.Name}})
+}{{end}}
+
+{{- define "connectStreamRuntimeMethod"}}func (c {{.Service.Instrumented}}) {{.Name}}(ctx context.Context) {{.StreamType}} {
+	stream, _ := runtime.OpenStream(ctx, {{template "runtimeConfig" .}}, func(ctx context.Context) ({{.StreamType}}, error) {
+		return c.inner.{{.Name}}(ctx), nil
+	})
+	return stream
+}{{end}}
+`
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// sourceDir is a directory to generate the instrumentation for, only the
+// given files of it are generated for if there are any.
+type sourceDir struct {
+	path  string
+	files []string
+}
+
+// skipDir returns whether a directory below the root of a walk is skipped,
+// the go command ignores these as well.
+func skipDir(name string) bool {
+	return strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata"
+}
+
+// patternRoot returns the directory a pattern refers to, which can be
+// relative to the working directory or an import path in the main module.
+func patternRoot(pattern string) string {
+	if pattern == "" {
+		return "."
+	}
+	if filepath.IsAbs(pattern) || pattern == "." || pattern == ".." ||
+		strings.HasPrefix(pattern, "./") || strings.HasPrefix(pattern, "../") {
+		return filepath.Clean(pattern)
+	}
+	if _, err := os.Stat(pattern); err == nil {
+		return filepath.Clean(pattern)
+	}
+
+	moduleDir, modulePath, err := findModule(".")
+	if err != nil {
+		return filepath.Clean(pattern)
+	}
+	if pattern == modulePath {
+		return moduleDir
+	}
+	rel, ok := strings.CutPrefix(pattern, modulePath+"/")
+	if !ok {
+		return filepath.Clean(pattern)
+	}
+	return filepath.Join(moduleDir, filepath.FromSlash(rel))
+}
+
+// resolvePatterns returns the directories matched by the given patterns in
+// the order they are walked in. A pattern is either:
+//   - a source file, which is generated for by itself
+//   - a directory followed by /..., matching it and the directories below it
+//     which aren't part of another module
+//   - a directory, matching it and every directory below it
+//
+// Hidden, vendor and testdata directories are skipped unless allDirs is set.
+func resolvePatterns(opts options, patterns []string, allDirs bool) []sourceDir {
+	var dirs []sourceDir
+	// whole is whether a directory is generated for without restricting it
+	// to some files, index is where it is in dirs
+	whole := make(map[string]bool)
+	index := make(map[string]int)
+	add := func(dir string, file string) {
+		i, ok := index[dir]
+		if !ok {
+			index[dir] = len(dirs)
+			dirs = append(dirs, sourceDir{path: dir})
+			i = len(dirs) - 1
+		}
+		if file == "" {
+			whole[dir] = true
+			dirs[i].files = nil
+			return
+		}
+		if !whole[dir] && !slices.Contains(dirs[i].files, file) {
+			dirs[i].files = append(dirs[i].files, file)
+		}
+	}
+
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, ".go") {
+			if _, ok := opts.outputName(filepath.Base(pattern)); !ok {
+				opts.logger.Printf("'%s' is not a connect, grpc or twirp source\n", pattern)
+				opts.recordWarning(pattern, "not a connect, grpc or twirp source")
+				continue
+			}
+			add(filepath.Dir(pattern), filepath.Base(pattern))
+			continue
+		}
+
+		root, goStyle := strings.CutSuffix(pattern, "...")
+		if goStyle {
+			root = strings.TrimSuffix(root, "/")
+		}
+		root = patternRoot(root)
+
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				opts.logger.Printf("failed to read directory '%s'\nerr: %v\n", path, err)
+				opts.recordError(path, err)
+				return nil
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if path != root {
+				if !allDirs && skipDir(d.Name()) {
+					return filepath.SkipDir
+				}
+				if goStyle {
+					if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+						return filepath.SkipDir
+					}
+				}
+			}
+			add(path, "")
+			return nil
+		})
+	}
+	return dirs
+}
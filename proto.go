@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
+	"github.com/bufbuild/protocompile"
+	"github.com/bufbuild/protocompile/linker"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// goPackage returns the import path and package name declared by the
+// go_package option of a file.
+func goPackage(file protoreflect.FileDescriptor) (string, string, error) {
+	opts, ok := file.Options().(*descriptorpb.FileOptions)
+	if !ok || opts.GetGoPackage() == "" {
+		return "", "", fmt.Errorf("'%s' does not declare a go_package option", file.Path())
+	}
+	importPath, name, found := strings.Cut(opts.GetGoPackage(), ";")
+	if !found {
+		name = importPath[strings.LastIndex(importPath, "/")+1:]
+		name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	}
+	return importPath, name, nil
+}
+
+// protoComment renders the leading comments of a descriptor as a go comment.
+func protoComment(desc protoreflect.Descriptor) string {
+	loc := desc.ParentFile().SourceLocations().ByDescriptor(desc)
+	comment := strings.TrimSuffix(loc.LeadingComments, "\n")
+	if comment == "" {
+		return ""
+	}
+
+	var builder strings.Builder
+	for _, line := range strings.Split(comment, "\n") {
+		builder.WriteString("//" + line + "\n")
+	}
+	return builder.String()
+}
+
+// parseProtoServices returns the connect client interfaces
+// protoc-gen-connect-go generates for the services of a file, along with the
+// name of the package they are generated into. If packageSuffix isn't empty
+// the interfaces are referred to from a separate package named after the
+// connect package with the suffix, which is returned instead.
+func parseProtoServices(file protoreflect.FileDescriptor, packageSuffix string) (string, []otelgen.Service, error) {
+	goImportPath, pkgName, err := goPackage(file)
+	if err != nil {
+		return "", nil, err
+	}
+	connectPkgName := pkgName + "connect"
+	intfPackage := ""
+	if packageSuffix != "" {
+		intfPackage = connectPkgName
+	}
+
+	var serviceList []otelgen.Service
+	services := file.Services()
+	for i := 0; i < services.Len(); i++ {
+		service := services.Get(i)
+		s := otelgen.Service{
+			Name:             string(service.Name()),
+			FullName:         string(service.FullName()),
+			Framework:        otelgen.FrameworkConnect,
+			Interface:        string(service.Name()) + "Client",
+			InterfacePackage: intfPackage,
+			Package:          connectPkgName,
+		}
+		if intfPackage != "" {
+			// protoc-gen-connect-go generates into a subdirectory of the
+			// go package
+			s.Imports = append(s.Imports, otelgen.Import{
+				Alias: intfPackage,
+				Path:  fmt.Sprintf("%q", path.Join(goImportPath, connectPkgName)),
+			})
+		}
+
+		// messages are qualified with the go package name like connect does
+		messageType := func(msg protoreflect.MessageDescriptor) (string, error) {
+			importPath, name, err := goPackage(msg.ParentFile())
+			if err != nil {
+				return "", err
+			}
+			imp := otelgen.Import{Alias: name, Path: fmt.Sprintf("%q", importPath)}
+			if !slices.Contains(s.Imports, imp) {
+				s.Imports = append(s.Imports, imp)
+			}
+			// nested messages are named Outer_Inner
+			goName := strings.TrimPrefix(string(msg.FullName()), string(msg.ParentFile().Package())+".")
+			return name + "." + strings.ReplaceAll(goName, ".", "_"), nil
+		}
+
+		methods := service.Methods()
+		for j := 0; j < methods.Len(); j++ {
+			method := methods.Get(j)
+			requestType, err := messageType(method.Input())
+			if err != nil {
+				return "", nil, err
+			}
+			responseType, err := messageType(method.Output())
+			if err != nil {
+				return "", nil, err
+			}
+
+			m := otelgen.Method{
+				Name:         string(method.Name()),
+				RequestType:  requestType,
+				ResponseType: responseType,
+				Doc:          protoComment(method),
+			}
+			if opts, ok := method.Options().(*descriptorpb.MethodOptions); ok && opts.GetDeprecated() {
+				if m.Doc != "" {
+					m.Doc += "//\n"
+				}
+				m.Doc += "// Deprecated: do not use.\n"
+			}
+
+			switch {
+			case method.IsStreamingClient() && method.IsStreamingServer():
+				m.Kind = otelgen.KindConnectStream
+				m.StreamKind = otelgen.StreamBidi
+				m.StreamType = fmt.Sprintf("*connect.BidiStreamForClient[%s, %s]", requestType, responseType)
+			case method.IsStreamingClient():
+				m.Kind = otelgen.KindConnectStream
+				m.StreamKind = otelgen.StreamClient
+				m.StreamType = fmt.Sprintf("*connect.ClientStreamForClient[%s, %s]", requestType, responseType)
+			case method.IsStreamingServer():
+				m.Kind = otelgen.KindConnectServerStream
+				m.StreamKind = otelgen.StreamServer
+				m.StreamType = fmt.Sprintf("*connect.ServerStreamForClient[%s]", responseType)
+			default:
+				m.Kind = otelgen.KindEnvelope
+				m.StreamKind = otelgen.StreamUnary
+			}
+			s.Methods = append(s.Methods, m)
+		}
+		serviceList = append(serviceList, s)
+	}
+
+	return connectPkgName + packageSuffix, serviceList, nil
+}
+
+// relativeToImportPath returns the path of a .proto file as it is imported,
+// relative to the import path containing it.
+func relativeToImportPath(path string, importPaths []string) string {
+	for _, importPath := range importPaths {
+		rel, err := filepath.Rel(importPath, path)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(path)
+}
+
+// compileProtoFiles compiles the given .proto files, it also returns the
+// paths they were given with keyed by their paths relative to the import
+// paths.
+func compileProtoFiles(paths []string, importPaths []string) (linker.Files, map[string]string, error) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: importPaths,
+		}),
+		SourceInfoMode: protocompile.SourceInfoStandard,
+	}
+
+	names := make([]string, len(paths))
+	sources := make(map[string]string, len(paths))
+	for i, path := range paths {
+		names[i] = relativeToImportPath(path, importPaths)
+		sources[names[i]] = path
+	}
+	files, err := compiler.Compile(context.Background(), names...)
+	return files, sources, err
+}
+
+// processProtoFiles compiles the given .proto files and writes the
+// instrumentation for the connect code generated from each of them, the
+// output mirrors the layout of protoc-gen-connect-go with
+// paths=source_relative.
+func processProtoFiles(opts options, paths []string, importPaths []string, outDir string) {
+	if len(importPaths) == 0 {
+		importPaths = []string{"."}
+	}
+	files, sources, err := compileProtoFiles(paths, importPaths)
+	if err != nil {
+		opts.recordError("", err)
+		opts.commitStaged()
+		opts.finishReport()
+		log.Fatalf("failed to compile proto files\nerr: %v\n", err)
+	}
+
+	// shared declarations are only written once per output package
+	declared := make(map[string]bool)
+	for _, file := range files {
+		start := time.Now()
+		source := sources[file.Path()]
+		pkgName, services, err := parseProtoServices(file, opts.packageSuffix)
+		if err != nil {
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", file.Path(), err)
+			opts.recordError(source, err)
+			opts.recordSource(source, "", statusFailed, nil, start)
+			continue
+		}
+		if len(services) == 0 {
+			opts.recordSource(source, "", statusSkipped, nil, start)
+			continue
+		}
+
+		dir := filepath.Join(outDir, filepath.Dir(file.Path()), pkgName)
+		generated, err := otelgen.Generate(services, otelgen.Options{
+			Package:       pkgName,
+			Source:        file.Path(),
+			DeclareShared: !declared[dir],
+			Templates:     opts.templates,
+			MethodOptions: opts.config.methodOptions,
+			Runtime:       opts.runtime,
+		})
+		if errors.Is(err, otelgen.ErrNoServices) {
+			opts.recordSource(source, "", statusSkipped, services, start)
+			continue
+		}
+		base := strings.TrimSuffix(filepath.Base(file.Path()), ".proto")
+		output := filepath.Join(dir, opts.outputFileName(base))
+		if err != nil {
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", file.Path(), err)
+			opts.recordError(source, err)
+			opts.recordSource(source, output, statusFailed, services, start)
+			continue
+		}
+		declared[dir] = true
+
+		status, err := opts.writeOutput(output, generated, source)
+		if err != nil {
+			opts.logger.Printf("failed to write generated code for source '%s'\nerr: %v\n", file.Path(), err)
+			opts.recordError(output, err)
+			status = statusFailed
+		}
+		opts.recordSource(source, output, status, services, start)
+	}
+
+	if !opts.prune {
+		return
+	}
+	// output directories are shared by every .proto file of a package, only
+	// the files generated from one which can't be found anymore are removed
+	dirs := make([]string, 0, len(declared))
+	for dir := range declared {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	for _, dir := range dirs {
+		opts.pruneDir(dir, func(path, source string) bool {
+			if opts.state.hasOutput(path) {
+				return false
+			}
+			for _, importPath := range importPaths {
+				_, err := os.Stat(filepath.Join(importPath, filepath.FromSlash(source)))
+				if err == nil {
+					return false
+				}
+			}
+			return true
+		})
+	}
+}
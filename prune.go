@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// generatedSource returns the source recorded in the header of a file
+// generated by connectrpc-otel-gen, the boolean is false if the file wasn't
+// generated by it.
+func generatedSource(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "// Code generated by connectrpc-otel-gen ") {
+		return "", false
+	}
+	// the header ends at the first line which isn't a comment
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+		source, ok := strings.CutPrefix(line, "// Source: ")
+		if ok {
+			return source, true
+		}
+	}
+	return "", true
+}
+
+// pruneDir removes the files generated by connectrpc-otel-gen in dir which
+// are orphaned according to the given function, in check mode they are
+// reported instead and the run is marked as stale.
+func (opts options) pruneDir(dir string, orphaned func(path, source string) bool) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		opts.logger.Printf("failed to read directory '%s'\nerr: %v\n", dir, err)
+		opts.recordError(dir, err)
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".go") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		source, ok := generatedSource(path)
+		if !ok || !orphaned(path, source) {
+			continue
+		}
+
+		if opts.check {
+			existing, err := os.ReadFile(path)
+			if err != nil {
+				opts.logger.Printf("failed to read orphaned generated file '%s'\nerr: %v\n", path, err)
+				opts.recordError(path, err)
+				continue
+			}
+			opts.state.markStale()
+			opts.state.addPruned(path)
+			fmt.Fprint(opts.stdout, unifiedDiff("a/"+filepath.ToSlash(path), "/dev/null", string(existing), ""))
+			continue
+		}
+		if opts.atomic {
+			opts.state.stageRemoval(path)
+			opts.state.addPruned(path)
+			continue
+		}
+		err := os.Remove(path)
+		if err != nil {
+			opts.logger.Printf("failed to remove orphaned generated file '%s'\nerr: %v\n", path, err)
+			opts.recordError(path, err)
+			continue
+		}
+		opts.state.addPruned(path)
+		opts.logger.Printf("removed orphaned generated file '%s'\n", path)
+	}
+}
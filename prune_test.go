@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const pruneSource = `package authv1
+
+import (
+	connect "connectrpc.com/connect"
+	context "context"
+)
+
+type Request struct{}
+
+type Response struct{}
+
+type AuthServiceClient interface {
+	Login(context.Context, *connect.Request[Request]) (*connect.Response[Response], error)
+}
+`
+
+// generatedFile returns the content of a file generated from source.
+func generatedFile(source string) string {
+	header := "// Code generated by connectrpc-otel-gen (devel). DO NOT EDIT.\n"
+	if source != "" {
+		header += "// Source: " + source + "\n"
+	}
+	return header + "\npackage authv1\n"
+}
+
+func TestPruneDir(t *testing.T) {
+	tests := []struct {
+		name string
+		// file is the name of the file in the directory of the source
+		// api.connect.go
+		file    string
+		content string
+		pruned  bool
+	}{
+		{
+			name:    "source removed",
+			file:    "old.telemetry.go",
+			content: generatedFile("old.connect.go"),
+			pruned:  true,
+		},
+		{
+			name:    "written under another name",
+			file:    "auth_otel.go",
+			content: generatedFile("api.connect.go"),
+		},
+		{
+			name:    "no source recorded",
+			file:    "stdin.telemetry.go",
+			content: generatedFile(""),
+			pruned:  true,
+		},
+		{
+			name:    "not generated",
+			file:    "helpers.go",
+			content: "package authv1\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := os.WriteFile(filepath.Join(dir, "api.connect.go"), []byte(pruneSource), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, test.file)
+			err = os.WriteFile(path, []byte(test.content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := testOptions()
+			opts.prune = true
+			if processDir(opts, sourceDir{path: dir}) != 1 {
+				t.Fatal("failed to generate for api.connect.go")
+			}
+			_, err = os.Stat(path)
+			if pruned := errors.Is(err, fs.ErrNotExist); pruned != test.pruned {
+				t.Errorf("got pruned %t, want %t", pruned, test.pruned)
+			}
+			_, err = os.Stat(filepath.Join(dir, "api.telemetry.go"))
+			if err != nil {
+				t.Errorf("the output of api.connect.go was removed\nerr: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go/scanner"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
+	"github.com/bufbuild/protocompile/reporter"
+)
+
+// the statuses of the output of a source in the report
+const (
+	statusWritten = "written"
+	// statusUnchanged is for outputs which were already up to date.
+	statusUnchanged = "unchanged"
+	// statusStale is for outputs which are out of date or missing in check
+	// mode.
+	statusStale = "stale"
+	// statusSkipped is for sources whose services are all skipped by the
+	// configuration.
+	statusSkipped = "skipped"
+	statusFailed  = "failed"
+	// statusDiscarded is for outputs staged with -atomic which were
+	// discarded as something else failed.
+	statusDiscarded = "discarded"
+)
+
+// report is the machine readable summary of a run written with -report.
+type report struct {
+	Version    string    `json:"version"`
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"durationMs"`
+	// Sources are the sources processed, sorted by path.
+	Sources []reportSource `json:"sources"`
+	// Pruned are the orphaned files removed, or reported in check mode.
+	Pruned      []string           `json:"pruned"`
+	Diagnostics []reportDiagnostic `json:"diagnostics"`
+}
+
+type reportSource struct {
+	Path     string          `json:"path"`
+	Output   string          `json:"output,omitempty"`
+	Status   string          `json:"status"`
+	Services []listedService `json:"services"`
+	// Cached is set if the output was found up to date in the cache
+	// without parsing the source.
+	Cached     bool    `json:"cached,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// reportDiagnostic is a warning or an error, with the position it refers to
+// if it has one.
+type reportDiagnostic struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// newDiagnostic returns the diagnostic for an error about a file, the
+// position is taken from go and proto syntax errors.
+func newDiagnostic(severity string, file string, err error) reportDiagnostic {
+	d := reportDiagnostic{Severity: severity, Message: err.Error(), File: file}
+
+	var list scanner.ErrorList
+	var withPos reporter.ErrorWithPos
+	switch {
+	case errors.As(err, &list) && len(list) > 0:
+		d.Message = list[0].Msg
+		d.File = list[0].Pos.Filename
+		d.Line = list[0].Pos.Line
+		d.Column = list[0].Pos.Column
+	case errors.As(err, &withPos):
+		pos := withPos.GetPosition()
+		d.Message = withPos.Unwrap().Error()
+		d.File = pos.Filename
+		d.Line = pos.Line
+		d.Column = pos.Col
+	}
+	return d
+}
+
+// addSource adds a source to the report if there is one.
+func (s *runState) addSource(source reportSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report != nil {
+		s.report.Sources = append(s.report.Sources, source)
+	}
+}
+
+// addDiagnostic adds a diagnostic to the report if there is one.
+func (s *runState) addDiagnostic(d reportDiagnostic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report != nil {
+		s.report.Diagnostics = append(s.report.Diagnostics, d)
+	}
+}
+
+// addPruned adds a pruned file to the report if there is one.
+func (s *runState) addPruned(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report != nil {
+		s.report.Pruned = append(s.report.Pruned, path)
+	}
+}
+
+// recordSource adds the outcome of generating for a source to the report,
+// along with the services found in it.
+func (opts options) recordSource(path, output, status string, parsed []otelgen.Service, start time.Time) {
+	services := listServices(opts.config, path, parsed)
+	if services == nil {
+		services = []listedService{}
+	}
+	opts.state.addSource(reportSource{
+		Path:       path,
+		Output:     output,
+		Status:     status,
+		Services:   services,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	})
+}
+
+// recordCachedSource adds a source whose output was found up to date in the
+// cache to the report.
+func (opts options) recordCachedSource(path, output string, services []listedService, start time.Time) {
+	opts.state.addSource(reportSource{
+		Path:       path,
+		Output:     output,
+		Status:     statusUnchanged,
+		Services:   services,
+		Cached:     true,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	})
+}
+
+// recordError adds an error about a file to the report.
+func (opts options) recordError(file string, err error) {
+	opts.state.markFailed()
+	opts.state.addDiagnostic(newDiagnostic("error", file, err))
+}
+
+// recordWarning adds a warning about a file to the report.
+func (opts options) recordWarning(file string, message string) {
+	opts.state.addDiagnostic(reportDiagnostic{Severity: "warning", Message: message, File: file})
+}
+
+// writeReport writes the report if there is one, what is recorded
+// concurrently is sorted so that it doesn't depend on scheduling.
+func (s *runState) writeReport() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report == nil {
+		return nil
+	}
+
+	r := s.report
+	r.DurationMs = float64(time.Since(r.Start)) / float64(time.Millisecond)
+	slices.SortStableFunc(r.Sources, func(a, b reportSource) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	slices.Sort(r.Pruned)
+	slices.SortStableFunc(r.Diagnostics, func(a, b reportDiagnostic) int {
+		if c := strings.Compare(a.File, b.File); c != 0 {
+			return c
+		}
+		return a.Line - b.Line
+	})
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.reportPath, append(data, '\n'), 0644)
+}
+
+// finishReport writes the report if there is one, logging if it can't be.
+func (opts options) finishReport() {
+	err := opts.state.writeReport()
+	if err != nil {
+		opts.logger.Printf("failed to write report '%s'\nerr: %v\n", opts.state.reportPath, err)
+	}
+}
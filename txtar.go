@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/LQR471814/connectrpc-otel-gen/otelgen"
+)
+
+// archiveFile is a file of a txtar archive, see
+// https://pkg.go.dev/golang.org/x/tools/txtar for the format.
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+// parseArchive parses a txtar archive, the comment before the first file is
+// returned separately.
+func parseArchive(data []byte) ([]byte, []archiveFile) {
+	comment, name, data := nextArchiveFile(data)
+	var files []archiveFile
+	for name != "" {
+		file := archiveFile{name: name}
+		file.data, name, data = nextArchiveFile(data)
+		files = append(files, file)
+	}
+	return comment, files
+}
+
+// nextArchiveFile returns the data up to the next file marker, the name of
+// the file it marks and what follows the marker.
+func nextArchiveFile(data []byte) ([]byte, string, []byte) {
+	for i := 0; i < len(data); {
+		line := data[i:]
+		end := bytes.IndexByte(line, '\n')
+		if end >= 0 {
+			line = line[:end+1]
+		}
+		if name, ok := archiveMarker(line); ok {
+			return data[:i], name, data[i+len(line):]
+		}
+		i += len(line)
+	}
+	return data, "", nil
+}
+
+// archiveMarker returns the name of the file a line marks the start of.
+func archiveMarker(line []byte) (string, bool) {
+	s := strings.TrimRight(string(line), "\r\n")
+	if !strings.HasPrefix(s, "-- ") || !strings.HasSuffix(s, " --") || len(s) < len("-- x --") {
+		return "", false
+	}
+	return strings.TrimSpace(s[len("-- ") : len(s)-len(" --")]), true
+}
+
+// formatArchive formats files as a txtar archive.
+func formatArchive(comment []byte, files []archiveFile) []byte {
+	var buf bytes.Buffer
+	buf.Write(comment)
+	if len(comment) > 0 && comment[len(comment)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	for _, file := range files {
+		fmt.Fprintf(&buf, "-- %s --\n", file.name)
+		buf.Write(file.data)
+		if len(file.data) > 0 && file.data[len(file.data)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// processArchive generates the instrumentation for the sources in a txtar
+// archive, returning an archive of the generated files at the paths they
+// would be written to if the archive was extracted. Files which aren't
+// sources are left out.
+func processArchive(opts options, input io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	_, files := parseArchive(data)
+	// the sources are processed in the order they would be read from disk,
+	// so the same one claims an output and declares what is shared
+	slices.SortStableFunc(files, func(a, b archiveFile) int {
+		return strings.Compare(path.Clean(a.name), path.Clean(b.name))
+	})
+
+	// the first source of a directory declares what is shared, even if it
+	// fails to generate
+	declared := make(map[string]bool)
+	claimed := make(map[string]string)
+	var outputs []archiveFile
+	for _, file := range files {
+		start := time.Now()
+		name := path.Clean(file.name)
+		output, ok := opts.outputName(path.Base(name))
+		if !ok {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			err := errors.New("the paths of the archive must be relative and inside of it")
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", file.name, err)
+			opts.recordError(file.name, err)
+			continue
+		}
+		dir := path.Dir(name)
+		if dir == "." && opts.packageSuffix != "" {
+			err := errors.New("the sibling package of a source at the root of the archive is outside of it")
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", file.name, err)
+			opts.recordError(file.name, err)
+			continue
+		}
+		outputPath := path.Join(opts.outputDir(dir), output)
+		if other, ok := claimed[outputPath]; ok {
+			err := duplicateOutputError(other, outputPath)
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", file.name, err)
+			opts.recordError(name, err)
+			opts.recordSource(name, outputPath, statusFailed, nil, start)
+			continue
+		}
+		claimed[outputPath] = name
+		declareShared := !declared[dir]
+		declared[dir] = true
+
+		// -source_import_path is the import path of the root of the archive
+		fileOpts := opts
+		if opts.packageSuffix != "" {
+			fileOpts.sourceImportPath = path.Join(opts.sourceImportPath, dir)
+		}
+		generated, services, err := processFile(fileOpts, name, bytes.NewReader(file.data), declareShared)
+		if errors.Is(err, otelgen.ErrNoServices) {
+			opts.recordSource(name, "", statusSkipped, services, start)
+			continue
+		}
+		if err != nil {
+			opts.logger.Printf("failed to generate instrumentation for source '%s'\nerr: %v\n", file.name, err)
+			opts.recordError(name, err)
+			opts.recordSource(name, outputPath, statusFailed, services, start)
+			continue
+		}
+		outputs = append(outputs, archiveFile{name: outputPath, data: []byte(generated)})
+		opts.recordSource(name, outputPath, statusWritten, services, start)
+	}
+	return formatArchive(nil, outputs), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+		// want is the formatted archive, the same as the parsed one if empty
+		want string
+	}{
+		{
+			name:    "comment",
+			archive: "a comment\n-- a.go --\npackage a\n-- b/b.go --\npackage b\n",
+		},
+		{
+			name:    "no comment",
+			archive: "-- a.go --\npackage a\n\n",
+		},
+		{
+			name:    "empty file",
+			archive: "-- a.go --\n-- b.go --\npackage b\n",
+		},
+		{
+			name:    "missing final newline",
+			archive: "comment\n-- a.go --\npackage a",
+			want:    "comment\n-- a.go --\npackage a\n",
+		},
+		{
+			name:    "not a marker",
+			archive: "-- a.go --\n-- --\n--b.go--\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := test.want
+			if want == "" {
+				want = test.archive
+			}
+			comment, files := parseArchive([]byte(test.archive))
+			got := string(formatArchive(comment, files))
+			if got != want {
+				t.Errorf("got archive\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestProcessArchive(t *testing.T) {
+	const broken = "package authv1\n\ntype AuthServiceClient interface {\n"
+	tests := []struct {
+		name          string
+		archive       string
+		packageSuffix string
+		// contains holds the lines of each generated file, the files which
+		// aren't in it must not be generated
+		contains map[string][]string
+		excludes map[string][]string
+	}{
+		{
+			name: "declared by the first path",
+			archive: "-- auth/b.connect.go --\n" + pruneSource +
+				"-- auth/a.connect.go --\n" + pruneSource,
+			contains: map[string][]string{
+				"auth/a.telemetry.go": {"type TracerLike interface"},
+				"auth/b.telemetry.go": {"package authv1"},
+			},
+			excludes: map[string][]string{
+				"auth/b.telemetry.go": {"type TracerLike interface"},
+			},
+		},
+		{
+			name: "declared by a failed source",
+			archive: "-- auth/b.connect.go --\n" + pruneSource +
+				"-- auth/a.connect.go --\n" + broken,
+			contains: map[string][]string{
+				"auth/b.telemetry.go": {"package authv1"},
+			},
+			excludes: map[string][]string{
+				"auth/b.telemetry.go": {"type TracerLike interface"},
+			},
+		},
+		{
+			name: "import path of each directory",
+			archive: "-- auth/api.connect.go --\n" + pruneSource +
+				"-- admin/v1/api.connect.go --\n" + pruneSource,
+			packageSuffix: "otel",
+			contains: map[string][]string{
+				"authotel/api.telemetry.go":     {`"example.com/root/auth"`},
+				"admin/v1otel/api.telemetry.go": {`"example.com/root/admin/v1"`},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.packageSuffix = test.packageSuffix
+			opts.sourceImportPath = "example.com/root"
+			out, err := processArchive(opts, strings.NewReader(test.archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, files := parseArchive(out)
+			if len(files) != len(test.contains) {
+				t.Errorf("got %d generated files, want %d\n%s", len(files), len(test.contains), out)
+			}
+			for _, file := range files {
+				lines, ok := test.contains[file.name]
+				if !ok {
+					t.Errorf("generated unexpected file %s", file.name)
+				}
+				for _, line := range lines {
+					if !bytes.Contains(file.data, []byte(line)) {
+						t.Errorf("%s doesn't contain %q\n%s", file.name, line, file.data)
+					}
+				}
+				for _, text := range test.excludes[file.name] {
+					if bytes.Contains(file.data, []byte(text)) {
+						t.Errorf("%s contains %q\n%s", file.name, text, file.data)
+					}
+				}
+			}
+		})
+	}
+}
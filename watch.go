@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// sourceStamp is what changes of a source are detected with.
+type sourceStamp struct {
+	modTime int64
+	size    int64
+}
+
+// scanSources returns the directories matched by the patterns along with the
+// stamps of their sources, keyed by directory and then path. Patterns are
+// resolved again on each scan so that new directories are picked up.
+func scanSources(opts options, patterns []string, allDirs bool) (map[string]sourceDir, map[string]map[string]sourceStamp) {
+	dirs := make(map[string]sourceDir)
+	sources := make(map[string]map[string]sourceStamp)
+	// errors are reported by the initial generation, not on every scan
+	quiet := opts
+	quiet.logger = log.New(io.Discard, "", 0)
+	for _, dir := range resolvePatterns(quiet, patterns, allDirs) {
+		entries, err := os.ReadDir(dir.path)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if _, ok := opts.outputName(e.Name()); !ok || e.IsDir() {
+				continue
+			}
+			if dir.files != nil && !slices.Contains(dir.files, e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			if sources[dir.path] == nil {
+				sources[dir.path] = make(map[string]sourceStamp)
+			}
+			path := filepath.Join(dir.path, e.Name())
+			sources[dir.path][path] = sourceStamp{modTime: info.ModTime().UnixNano(), size: info.Size()}
+		}
+		dirs[dir.path] = dir
+	}
+	return dirs, sources
+}
+
+// changedDirs returns the sorted directories in which a source was added,
+// changed or removed between two scans.
+func changedDirs(prev, cur map[string]map[string]sourceStamp) []string {
+	var dirs []string
+	for dir, sources := range cur {
+		previous, ok := prev[dir]
+		if !ok || len(previous) != len(sources) {
+			dirs = append(dirs, dir)
+			continue
+		}
+		for path, stamp := range sources {
+			if previous[path] != stamp {
+				dirs = append(dirs, dir)
+				break
+			}
+		}
+	}
+	for dir := range prev {
+		if _, ok := cur[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+// watch polls the directories matched by the patterns for changes to sources
+// and regenerates the instrumentation of the directories they are in, it
+// never returns.
+func watch(opts options, patterns []string, allDirs bool, interval time.Duration) {
+	_, prev := scanSources(opts, patterns, allDirs)
+	opts.logger.Printf("watching %d directories with sources for changes\n", len(prev))
+
+	for {
+		time.Sleep(interval)
+		matched, cur := scanSources(opts, patterns, allDirs)
+		var dirs []sourceDir
+		for _, dir := range changedDirs(prev, cur) {
+			source, ok := matched[dir]
+			if !ok {
+				// the directory was removed, its outputs are still pruned
+				source = sourceDir{path: dir}
+			}
+			dirs = append(dirs, source)
+		}
+		if len(dirs) > 0 {
+			start := time.Now()
+			counts := processDirs(opts, dirs)
+			for i, dir := range dirs {
+				opts.logger.Printf("regenerated %d files for '%s'\n", counts[i], dir.path)
+			}
+			opts.logger.Printf("regenerated %d directories in %s\n", len(dirs), time.Since(start).Round(time.Millisecond))
+			opts.commitStaged()
+			opts.saveCache()
+		}
+		prev = cur
+	}
+}